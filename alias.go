@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	minAliasLength = 3
+	maxAliasLength = 32
+)
+
+var (
+	ErrInvalidAlias  = fmt.Errorf("alias must be %d-%d characters of letters, digits, '-' or '_'", minAliasLength, maxAliasLength)
+	ErrReservedAlias = errors.New("alias is reserved")
+	ErrAliasTaken    = errors.New("alias is already in use")
+)
+
+var aliasPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// reservedAliases protects top-level routes (and names we may route later)
+// from being shadowed by a short code. Matching is case-insensitive.
+var reservedAliases = map[string]bool{
+	"":        true,
+	"api":     true,
+	"health":  true,
+	"metrics": true,
+	"admin":   true,
+	"static":  true,
+	"preview": true,
+}
+
+func isReservedAlias(alias string) bool {
+	return reservedAliases[strings.ToLower(alias)]
+}
+
+func validateAlias(alias string) error {
+	if isReservedAlias(alias) {
+		return ErrReservedAlias
+	}
+	if len(alias) < minAliasLength || len(alias) > maxAliasLength || !aliasPattern.MatchString(alias) {
+		return ErrInvalidAlias
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Clicks are classified as bot or human traffic from their User-Agent.
+// Built-in patterns cover common crawlers, link unfurlers and HTTP
+// libraries; BOT_RULES_FILE can add rules, one per line:
+//
+//	# comments and blank lines are ignored
+//	bot    internal-monitor/\d+
+//	human  ^Mozilla/5\.0 .*MyEmbeddedBrowser
+//
+// Patterns are case-insensitive regular expressions matched anywhere in the
+// User-Agent. Human rules win over bot rules and the built-in patterns, so
+// they can exempt a client the built-in list would flag. Requests without a
+// User-Agent are bots.
+
+// botUserAgentPatterns are lower-case substrings found in the User-Agent of
+// crawlers, link unfurlers and HTTP libraries.
+var botUserAgentPatterns = []string{
+	"bot", "crawler", "spider", "slurp", "crawl", "preview",
+	"facebookexternalhit", "whatsapp", "headlesschrome", "lighthouse",
+	"curl/", "wget/", "python-requests", "python-urllib", "go-http-client",
+	"java/", "okhttp", "libwww-perl", "httpclient", "axios/", "node-fetch",
+}
+
+type botClassifier struct {
+	bot   []*regexp.Regexp
+	human []*regexp.Regexp
+}
+
+// newBotClassifier returns a classifier using the built-in patterns plus
+// the rules in path, if one is given.
+func newBotClassifier(path string) (*botClassifier, error) {
+	c := &botClassifier{}
+	if path == "" {
+		return c, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening bot rules: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kind, pattern := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			kind, pattern = line[:i], strings.TrimSpace(line[i:])
+		}
+		if pattern == "" {
+			return nil, fmt.Errorf("%s:%d: rule has no pattern", path, lineNo)
+		}
+		re, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+
+		switch kind {
+		case "bot":
+			c.bot = append(c.bot, re)
+		case "human":
+			c.human = append(c.human, re)
+		default:
+			return nil, fmt.Errorf("%s:%d: rule must start with bot or human", path, lineNo)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading bot rules: %w", err)
+	}
+
+	log.Printf("Loaded %d bot and %d human rules from %s", len(c.bot), len(c.human), path)
+	return c, nil
+}
+
+// IsBot reports whether a User-Agent belongs to automated traffic.
+func (c *botClassifier) IsBot(ua string) bool {
+	for _, re := range c.human {
+		if re.MatchString(ua) {
+			return false
+		}
+	}
+	if strings.TrimSpace(ua) == "" {
+		return true
+	}
+	for _, re := range c.bot {
+		if re.MatchString(ua) {
+			return true
+		}
+	}
+
+	lower := strings.ToLower(ua)
+	for _, pattern := range botUserAgentPatterns {
+		if strings.Contains(lower, pattern) {
+			return true
+		}
+	}
+	return false
+}
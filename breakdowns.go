@@ -0,0 +1,46 @@
+package main
+
+// Breakdowns aggregate a link's analytics rows by one dimension each.
+
+const breakdownLimit = 10
+
+// BreakdownEntry counts the clicks that share one value of a dimension.
+// Empty values are reported as "direct" for referrers, "default" for
+// targeting rules (the click went to long_url), "none" for variants and
+// "unknown" for the other dimensions.
+type BreakdownEntry struct {
+	Value  string `json:"value"`
+	Clicks int    `json:"clicks"`
+}
+
+// breakdownDimensions maps each breakdown in the stats response to the
+// analytics column it groups by.
+var breakdownDimensions = []struct {
+	name, column string
+}{
+	{"referrers", "referrer_domain"},
+	{"browsers", "browser"},
+	{"os", "os"},
+	{"devices", "device"},
+	{"languages", "language"},
+	{"countries", "country"},
+	{"regions", "region"},
+	{"cities", "city"},
+	{"target_rules", "target_rule"},
+	{"variants", "variant"},
+}
+
+func breakdownLabel(name, value string) string {
+	if value != "" {
+		return value
+	}
+	switch name {
+	case "referrers":
+		return "direct"
+	case "target_rules":
+		return "default"
+	case "variants":
+		return "none"
+	}
+	return "unknown"
+}
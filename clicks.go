@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Click counts are kept out of the database on the redirect path: each
+// redirect increments a counter, and the counters are periodically flushed
+// to the store as one aggregated delta per link. The click count of a link
+// is the stored value plus its pending delta.
+type clickCounter interface {
+	Incr(ctx context.Context, key LinkKey, bot bool) error
+	Pending(ctx context.Context, key LinkKey) (ClickCounts, error)
+	// Drain removes and returns all pending deltas.
+	Drain(ctx context.Context) (map[LinkKey]ClickCounts, error)
+	// Restore adds back deltas that could not be written to the store.
+	Restore(ctx context.Context, deltas map[LinkKey]ClickCounts) error
+}
+
+// ClickCounts holds the clicks of a link. Total includes the clicks
+// classified as bot traffic.
+type ClickCounts struct {
+	Total int
+	Bots  int
+}
+
+// Human returns the clicks not classified as bot traffic.
+func (c ClickCounts) Human() int {
+	return c.Total - c.Bots
+}
+
+func (c ClickCounts) add(o ClickCounts) ClickCounts {
+	return ClickCounts{Total: c.Total + o.Total, Bots: c.Bots + o.Bots}
+}
+
+// clickOf is the delta of a single click.
+func clickOf(bot bool) ClickCounts {
+	if bot {
+		return ClickCounts{Total: 1, Bots: 1}
+	}
+	return ClickCounts{Total: 1}
+}
+
+func newClickCounter(cfg *Config, rdb *redis.Client) clickCounter {
+	if cfg.ClickCounter == "memory" {
+		return newShardedCounter()
+	}
+	return &redisClickCounter{rdb: rdb, fallback: newShardedCounter()}
+}
+
+const clickShards = 32
+
+// shardedCounter counts clicks in process. Links are spread over shards so
+// that concurrent redirects for different links rarely share a lock.
+type shardedCounter struct {
+	shards [clickShards]struct {
+		mu     sync.Mutex
+		counts map[LinkKey]ClickCounts
+	}
+}
+
+func newShardedCounter() *shardedCounter {
+	c := &shardedCounter{}
+	for i := range c.shards {
+		c.shards[i].counts = make(map[LinkKey]ClickCounts)
+	}
+	return c
+}
+
+func (c *shardedCounter) shard(key LinkKey) int {
+	h := fnv.New32a()
+	h.Write([]byte(key.Domain))
+	h.Write([]byte{0})
+	h.Write([]byte(key.ShortCode))
+	return int(h.Sum32() % clickShards)
+}
+
+func (c *shardedCounter) add(key LinkKey, n ClickCounts) {
+	s := &c.shards[c.shard(key)]
+	s.mu.Lock()
+	s.counts[key] = s.counts[key].add(n)
+	s.mu.Unlock()
+}
+
+func (c *shardedCounter) Incr(ctx context.Context, key LinkKey, bot bool) error {
+	c.add(key, clickOf(bot))
+	return nil
+}
+
+func (c *shardedCounter) Pending(ctx context.Context, key LinkKey) (ClickCounts, error) {
+	s := &c.shards[c.shard(key)]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counts[key], nil
+}
+
+func (c *shardedCounter) Drain(ctx context.Context) (map[LinkKey]ClickCounts, error) {
+	deltas := make(map[LinkKey]ClickCounts)
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		for key, n := range s.counts {
+			deltas[key] = deltas[key].add(n)
+		}
+		s.counts = make(map[LinkKey]ClickCounts)
+		s.mu.Unlock()
+	}
+	return deltas, nil
+}
+
+func (c *shardedCounter) Restore(ctx context.Context, deltas map[LinkKey]ClickCounts) error {
+	for key, n := range deltas {
+		c.add(key, n)
+	}
+	return nil
+}
+
+// Redis keys here share a namespace with the link cache, whose default-domain
+// keys are bare short codes. The dirty set contains a ':', which neither short
+// codes nor aliases may, and no counter key starts with "dirty:".
+const (
+	clickKeyPrefix    = "clicks:"
+	botClickKeyPrefix = "botclicks:"
+	clickDirtySet     = "dirty:clicks"
+	clickDrainSize    = 1000
+)
+
+// redisClickCounter counts clicks with INCR so that every instance sees the
+// same pending deltas; bot clicks are also counted under a second key. Each
+// counted link is added to a set, so the flush only visits links that have
+// clicks; because the counters are incremented before the link joins the
+// set, a click racing with a drain is either drained with it or left for
+// the next one. Clicks are counted in process while Redis is unreachable.
+type redisClickCounter struct {
+	rdb      *redis.Client
+	fallback *shardedCounter
+}
+
+func clickKey(key LinkKey) string {
+	return clickKeyPrefix + cacheKey(key.Domain, key.ShortCode)
+}
+
+func botClickKey(key LinkKey) string {
+	return botClickKeyPrefix + cacheKey(key.Domain, key.ShortCode)
+}
+
+// parseClickMember reverses cacheKey for members of the dirty set. Neither
+// hosts nor short codes contain a slash.
+func parseClickMember(member string) LinkKey {
+	if domain, shortCode, ok := strings.Cut(member, "/"); ok {
+		return LinkKey{Domain: domain, ShortCode: shortCode}
+	}
+	return LinkKey{ShortCode: member}
+}
+
+func (c *redisClickCounter) Incr(ctx context.Context, key LinkKey, bot bool) error {
+	_, err := c.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Incr(ctx, clickKey(key))
+		if bot {
+			pipe.Incr(ctx, botClickKey(key))
+		}
+		pipe.SAdd(ctx, clickDirtySet, cacheKey(key.Domain, key.ShortCode))
+		return nil
+	})
+	if err != nil {
+		c.fallback.add(key, clickOf(bot))
+		return fmt.Errorf("counting click in Redis, counted locally instead: %w", err)
+	}
+	return nil
+}
+
+func (c *redisClickCounter) Pending(ctx context.Context, key LinkKey) (ClickCounts, error) {
+	local, _ := c.fallback.Pending(ctx, key)
+	values, err := c.rdb.MGet(ctx, clickKey(key), botClickKey(key)).Result()
+	if err != nil {
+		return local, err
+	}
+	return local.add(ClickCounts{Total: redisInt(values[0]), Bots: redisInt(values[1])}), nil
+}
+
+// redisInt converts an MGET value, which is nil for a missing key.
+func redisInt(value interface{}) int {
+	s, _ := value.(string)
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+func (c *redisClickCounter) Drain(ctx context.Context) (map[LinkKey]ClickCounts, error) {
+	deltas, _ := c.fallback.Drain(ctx)
+
+	for {
+		members, err := c.rdb.SPopN(ctx, clickDirtySet, clickDrainSize).Result()
+		if err != nil {
+			return deltas, err
+		}
+		if len(members) == 0 {
+			return deltas, nil
+		}
+
+		totals := make([]*redis.StringCmd, len(members))
+		bots := make([]*redis.StringCmd, len(members))
+		// Each GETDEL is checked on its own below: counters read by the
+		// commands that succeeded are already deleted from Redis.
+		c.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, member := range members {
+				totals[i] = pipe.GetDel(ctx, clickKeyPrefix+member)
+				bots[i] = pipe.GetDel(ctx, botClickKeyPrefix+member)
+			}
+			return nil
+		})
+
+		var failed []interface{}
+		for i, member := range members {
+			var n ClickCounts
+			var errTotal, errBots error
+			n.Total, errTotal = redisCount(totals[i])
+			n.Bots, errBots = redisCount(bots[i])
+			if errTotal != nil || errBots != nil {
+				// Put the link back so its remaining counter is drained later.
+				failed = append(failed, member)
+				if err = errTotal; err == nil {
+					err = errBots
+				}
+			}
+			if n != (ClickCounts{}) {
+				key := parseClickMember(member)
+				deltas[key] = deltas[key].add(n)
+			}
+		}
+		if len(failed) > 0 {
+			if addErr := c.rdb.SAdd(ctx, clickDirtySet, failed...).Err(); addErr != nil {
+				log.Printf("Error re-marking %d links with undrained clicks: %v", len(failed), addErr)
+			}
+			return deltas, err
+		}
+	}
+}
+
+// redisCount reads a GETDEL result; a missing key counts as zero.
+func redisCount(cmd *redis.StringCmd) (int, error) {
+	n, err := cmd.Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return n, err
+}
+
+func (c *redisClickCounter) Restore(ctx context.Context, deltas map[LinkKey]ClickCounts) error {
+	_, err := c.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for key, n := range deltas {
+			pipe.IncrBy(ctx, clickKey(key), int64(n.Total))
+			if n.Bots != 0 {
+				pipe.IncrBy(ctx, botClickKey(key), int64(n.Bots))
+			}
+			pipe.SAdd(ctx, clickDirtySet, cacheKey(key.Domain, key.ShortCode))
+		}
+		return nil
+	})
+	if err != nil {
+		c.fallback.Restore(ctx, deltas)
+	}
+	return err
+}
+
+// countClick records a redirect for key.
+func (us *URLShortener) countClick(ctx context.Context, key LinkKey, bot bool) {
+	if err := us.clicks.Incr(ctx, key, bot); err != nil {
+		log.Printf("Error counting click for %s: %v", key.ShortCode, err)
+	}
+}
+
+// clickCount returns the stored click counts of a link plus its pending delta.
+func (us *URLShortener) clickCount(ctx context.Context, domain, shortCode string) (ClickCounts, error) {
+	stored, err := us.store.GetClicks(ctx, domain, shortCode)
+	if err != nil {
+		return ClickCounts{}, err
+	}
+	pending, err := us.clicks.Pending(ctx, LinkKey{domain, shortCode})
+	if err != nil {
+		log.Printf("Error reading pending clicks for %s: %v", shortCode, err)
+	}
+	return stored.add(pending), nil
+}
+
+// clickFlusher periodically writes pending click deltas to the store, and
+// once more on shutdown.
+func (us *URLShortener) clickFlusher(interval time.Duration) {
+	defer us.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-us.quit:
+			us.flushClicks()
+			return
+		case <-ticker.C:
+			us.flushClicks()
+		}
+	}
+}
+
+func (us *URLShortener) flushClicks() {
+	ctx, cancel := context.WithTimeout(us.flushCtx, 30*time.Second)
+	defer cancel()
+
+	deltas, err := us.clicks.Drain(ctx)
+	if err != nil {
+		log.Printf("Error draining click counters: %v", err)
+	}
+	if len(deltas) == 0 {
+		return
+	}
+
+	if err := us.store.AddClicks(ctx, deltas); err != nil {
+		log.Printf("Error flushing clicks for %d links, will retry: %v", len(deltas), err)
+		// Restoring must outlive a cancelled flush context, or the
+		// clicks would be lost on shutdown.
+		restoreCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := us.clicks.Restore(restoreCtx, deltas); err != nil {
+			log.Printf("Error restoring click counters: %v", err)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// runCommand dispatches the admin commands that can be given on the command
+// line instead of starting the server.
+func runCommand(store Store, args []string) error {
+	defer store.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := store.Migrate(ctx); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "apikey":
+		return runAPIKeyCommand(store, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q (available: apikey)", args[0])
+	}
+}
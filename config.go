@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	Port           string
+	StorageBackend string
+	DatabaseURL    string
+	SQLitePath     string
+	RedisAddr      string
+
+	// BaseURL is the public URL of the default domain. BrandedDomains maps
+	// each additional host to its public base URL.
+	BaseURL        string
+	BrandedDomains map[string]string
+
+	ExpirySweepInterval time.Duration
+
+	// ShutdownTimeout bounds how long in-flight requests may take to finish
+	// on shutdown; AnalyticsFlushTimeout bounds the final analytics flush.
+	ShutdownTimeout       time.Duration
+	AnalyticsFlushTimeout time.Duration
+
+	// SpillDir holds analytics events that could not be written to the
+	// store; they are replayed every SpillReplayInterval.
+	SpillDir            string
+	SpillReplayInterval time.Duration
+
+	// ClickCounter selects where redirects are counted before being flushed
+	// to the store every ClickFlushInterval: "redis" or "memory".
+	ClickCounter       string
+	ClickFlushInterval time.Duration
+
+	// GeoIPDBPath is a MaxMind-format database used to geolocate clicks.
+	// Geolocation is skipped when it is empty or the file does not exist.
+	GeoIPDBPath string
+
+	// CountryHeader names a request header carrying the visitor's country
+	// code, set by a CDN or proxy in front of us, e.g. CF-IPCountry. It takes
+	// precedence over GeoIP for targeting rules.
+	CountryHeader string
+
+	// BotRulesFile holds extra rules for telling bot clicks from human
+	// ones; see botfilter.go for the format.
+	BotRulesFile string
+
+	// AllowedURLSchemes, DomainRulesFile and BlockPrivateDestinations
+	// configure the checks destinations must pass; see urlcheck.go.
+	AllowedURLSchemes        []string
+	DomainRulesFile          string
+	BlockPrivateDestinations bool
+
+	// ThreatListSource is a file or http:// URL holding the threat list,
+	// reloaded every ThreatListRefreshInterval; see threats.go.
+	ThreatListSource          string
+	ThreatListRefreshInterval time.Duration
+
+	// DefaultRedirectType is the status code of links without their own
+	// redirect_type. Permanent redirects may be cached by clients for up to
+	// PermanentRedirectMaxAge.
+	DefaultRedirectType     int
+	PermanentRedirectMaxAge time.Duration
+
+	// LinkCookieSecret signs the cookies that admit visitors to
+	// password-protected links for LinkAccessTTL. Each client IP gets
+	// PasswordAttemptLimit attempts per PasswordAttemptWindow, and each link
+	// PasswordLinkAttemptLimit attempts from all clients together.
+	LinkCookieSecret         string
+	LinkAccessTTL            time.Duration
+	PasswordAttemptLimit     int
+	PasswordLinkAttemptLimit int
+	PasswordAttemptWindow    time.Duration
+
+	// TrustedProxies are the networks of reverse proxies whose
+	// X-Forwarded-For entries are believed when rate limiting.
+	TrustedProxies []*net.IPNet
+
+	// IPAnonymization is "none", "truncate" or "hash"; IPHashKey keys the
+	// hash. VisitorHashKey keys the visitor fingerprints behind unique
+	// visitor estimates. AnalyticsRetention, when non-zero, is how long raw
+	// analytics rows are kept; they are pruned every RetentionSweepInterval.
+	IPAnonymization        string
+	IPHashKey              string
+	VisitorHashKey         string
+	AnalyticsRetention     time.Duration
+	RetentionSweepInterval time.Duration
+}
+
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func getEnvDuration(key string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid %s: must be positive", key)
+	}
+	return d, nil
+}
+
+func getEnvInt(key string, fallback int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s: must be a positive integer", key)
+	}
+	return n, nil
+}
+
+// parseBaseURL validates a public base URL and returns it without a trailing
+// slash, along with its lower-cased host.
+func parseBaseURL(raw string) (string, string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", "", fmt.Errorf("invalid base URL %q", raw)
+	}
+	return strings.TrimRight(u.String(), "/"), strings.ToLower(u.Host), nil
+}
+
+func LoadConfig() (*Config, error) {
+	var err error
+	cfg := &Config{
+		Port:             getEnv("PORT", "8080"),
+		StorageBackend:   getEnv("STORAGE_BACKEND", "postgres"),
+		DatabaseURL:      os.Getenv("DATABASE_URL"),
+		SQLitePath:       getEnv("SQLITE_PATH", "urlshortener.db"),
+		RedisAddr:        os.Getenv("REDIS_ADDR"),
+		SpillDir:         getEnv("SPILL_DIR", "analytics-spill"),
+		ClickCounter:     getEnv("CLICK_COUNTER", "redis"),
+		GeoIPDBPath:      os.Getenv("GEOIP_DB_PATH"),
+		BotRulesFile:     os.Getenv("BOT_RULES_FILE"),
+		DomainRulesFile:  os.Getenv("DOMAIN_RULES_FILE"),
+		ThreatListSource: os.Getenv("THREAT_LIST_SOURCE"),
+		CountryHeader:    os.Getenv("COUNTRY_HEADER"),
+		BrandedDomains:   make(map[string]string),
+
+		IPAnonymization: getEnv("IP_ANONYMIZATION", ipAnonymizeNone),
+		IPHashKey:       os.Getenv("IP_HASH_KEY"),
+		VisitorHashKey:  getEnv("VISITOR_HASH_KEY", os.Getenv("IP_HASH_KEY")),
+
+		LinkCookieSecret: os.Getenv("LINK_COOKIE_SECRET"),
+	}
+
+	switch cfg.StorageBackend {
+	case "postgres":
+		if cfg.DatabaseURL == "" {
+			return nil, fmt.Errorf("DATABASE_URL environment variable is required")
+		}
+	case "sqlite", "memory":
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q (expected postgres, sqlite or memory)", cfg.StorageBackend)
+	}
+
+	if cfg.ClickCounter != "redis" && cfg.ClickCounter != "memory" {
+		return nil, fmt.Errorf("unknown CLICK_COUNTER %q (expected redis or memory)", cfg.ClickCounter)
+	}
+
+	switch cfg.IPAnonymization {
+	case ipAnonymizeNone, ipAnonymizeTruncate:
+	case ipAnonymizeHash:
+		if cfg.IPHashKey == "" {
+			return nil, fmt.Errorf("IP_HASH_KEY is required when IP_ANONYMIZATION is hash")
+		}
+	default:
+		return nil, fmt.Errorf("unknown IP_ANONYMIZATION %q (expected none, truncate or hash)", cfg.IPAnonymization)
+	}
+
+	for _, scheme := range strings.Split(getEnv("ALLOWED_URL_SCHEMES", "http,https"), ",") {
+		if scheme = strings.ToLower(strings.TrimSpace(scheme)); scheme != "" {
+			cfg.AllowedURLSchemes = append(cfg.AllowedURLSchemes, scheme)
+		}
+	}
+	if len(cfg.AllowedURLSchemes) == 0 {
+		return nil, fmt.Errorf("ALLOWED_URL_SCHEMES must list at least one scheme")
+	}
+	if raw := os.Getenv("BLOCK_PRIVATE_DESTINATIONS"); raw != "" {
+		if cfg.BlockPrivateDestinations, err = strconv.ParseBool(raw); err != nil {
+			return nil, fmt.Errorf("invalid BLOCK_PRIVATE_DESTINATIONS: must be true or false")
+		}
+	}
+
+	if cfg.ThreatListRefreshInterval, err = getEnvDuration("THREAT_LIST_REFRESH_INTERVAL", 15*time.Minute); err != nil {
+		return nil, err
+	}
+
+	if cfg.DefaultRedirectType, err = strconv.Atoi(getEnv("DEFAULT_REDIRECT_TYPE", "301")); err != nil || validateRedirectType(cfg.DefaultRedirectType) != nil {
+		return nil, fmt.Errorf("invalid DEFAULT_REDIRECT_TYPE (expected 301, 302, 307 or 308)")
+	}
+	if cfg.PermanentRedirectMaxAge, err = getEnvDuration("PERMANENT_REDIRECT_MAX_AGE", time.Hour); err != nil {
+		return nil, err
+	}
+
+	if cfg.LinkAccessTTL, err = getEnvDuration("LINK_ACCESS_TTL", 15*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.PasswordAttemptLimit, err = getEnvInt("PASSWORD_ATTEMPT_LIMIT", 5); err != nil {
+		return nil, err
+	}
+	if cfg.PasswordLinkAttemptLimit, err = getEnvInt("PASSWORD_LINK_ATTEMPT_LIMIT", 50); err != nil {
+		return nil, err
+	}
+	if cfg.PasswordAttemptWindow, err = getEnvDuration("PASSWORD_ATTEMPT_WINDOW", 15*time.Minute); err != nil {
+		return nil, err
+	}
+
+	if proxies := os.Getenv("TRUSTED_PROXIES"); proxies != "" {
+		for _, raw := range strings.Split(proxies, ",") {
+			raw = strings.TrimSpace(raw)
+			if !strings.Contains(raw, "/") {
+				if ip := net.ParseIP(raw); ip != nil && ip.To4() != nil {
+					raw += "/32"
+				} else {
+					raw += "/128"
+				}
+			}
+			_, network, err := net.ParseCIDR(raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid TRUSTED_PROXIES entry %q", raw)
+			}
+			cfg.TrustedProxies = append(cfg.TrustedProxies, network)
+		}
+	}
+
+	if cfg.RedisAddr == "" {
+		return nil, fmt.Errorf("REDIS_ADDR environment variable is required")
+	}
+
+	if cfg.BaseURL, _, err = parseBaseURL(getEnv("BASE_URL", "http://localhost:"+cfg.Port)); err != nil {
+		return nil, fmt.Errorf("BASE_URL: %w", err)
+	}
+
+	if branded := os.Getenv("BRANDED_DOMAINS"); branded != "" {
+		for _, raw := range strings.Split(branded, ",") {
+			baseURL, host, err := parseBaseURL(raw)
+			if err != nil {
+				return nil, fmt.Errorf("BRANDED_DOMAINS: %w", err)
+			}
+			cfg.BrandedDomains[host] = baseURL
+		}
+	}
+
+	if cfg.ExpirySweepInterval, err = getEnvDuration("EXPIRY_SWEEP_INTERVAL", time.Minute); err != nil {
+		return nil, err
+	}
+
+	if cfg.ShutdownTimeout, err = getEnvDuration("SHUTDOWN_TIMEOUT", 15*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.AnalyticsFlushTimeout, err = getEnvDuration("ANALYTICS_FLUSH_TIMEOUT", 10*time.Second); err != nil {
+		return nil, err
+	}
+
+	if cfg.SpillReplayInterval, err = getEnvDuration("SPILL_REPLAY_INTERVAL", 10*time.Second); err != nil {
+		return nil, err
+	}
+
+	if cfg.ClickFlushInterval, err = getEnvDuration("CLICK_FLUSH_INTERVAL", 5*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.AnalyticsRetention, err = getEnvDuration("ANALYTICS_RETENTION", 0); err != nil {
+		return nil, err
+	}
+	if cfg.RetentionSweepInterval, err = getEnvDuration("RETENTION_SWEEP_INTERVAL", time.Hour); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
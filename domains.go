@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Links are identified by (domain, short code). The default domain, served
+// at BASE_URL, is stored as the empty string so that links keep working when
+// BASE_URL changes; branded domains are stored by their host.
+
+var ErrUnknownDomain = errors.New("unknown domain")
+
+func (us *URLShortener) defaultHost() string {
+	u, _ := url.Parse(us.cfg.BaseURL)
+	return strings.ToLower(u.Host)
+}
+
+// resolveDomain maps a domain name given by an API caller to its stored form.
+func (us *URLShortener) resolveDomain(name string) (string, error) {
+	name = strings.ToLower(name)
+	if name == "" || name == us.defaultHost() {
+		return "", nil
+	}
+	if _, ok := us.cfg.BrandedDomains[name]; ok {
+		return name, nil
+	}
+	return "", ErrUnknownDomain
+}
+
+// domainForHost maps a request Host header to its stored domain. Hosts that
+// are not branded domains (localhost, internal addresses, the default
+// domain itself) all resolve to the default domain.
+func (us *URLShortener) domainForHost(host string) string {
+	host = strings.ToLower(host)
+	if _, ok := us.cfg.BrandedDomains[host]; ok {
+		return host
+	}
+	return ""
+}
+
+// requestDomain picks the domain an API request refers to: the "domain"
+// query parameter if present, otherwise the Host header.
+func (us *URLShortener) requestDomain(r *http.Request) (string, error) {
+	if name := r.URL.Query().Get("domain"); name != "" {
+		return us.resolveDomain(name)
+	}
+	return us.domainForHost(r.Host), nil
+}
+
+func (us *URLShortener) baseURLFor(domain string) string {
+	if baseURL, ok := us.cfg.BrandedDomains[domain]; ok {
+		return baseURL
+	}
+	return us.cfg.BaseURL
+}
+
+func (us *URLShortener) shortURL(u *URL) string {
+	return us.baseURLFor(u.Domain) + "/" + u.ShortCode
+}
+
+// cacheKey is the Redis key for a link. Default-domain links keep the bare
+// short code as their key.
+func cacheKey(domain, shortCode string) string {
+	if domain == "" {
+		return shortCode
+	}
+	return domain + "/" + shortCode
+}
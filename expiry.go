@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// isExpired reports whether u has passed its expiry time or click budget.
+// The cached record's click count is stale, so links with max_clicks are
+// checked against the stored count plus pending clicks. Concurrent redirects
+// can still overshoot the budget by a few clicks.
+func (us *URLShortener) isExpired(ctx context.Context, u *URL) (bool, error) {
+	if u.ArchivedAt != nil {
+		return true, nil
+	}
+	if u.ExpiresAt != nil && !time.Now().Before(*u.ExpiresAt) {
+		return true, nil
+	}
+	if u.MaxClicks != nil {
+		clicks, err := us.clickCount(ctx, u.Domain, u.ShortCode)
+		if err != nil {
+			return false, err
+		}
+		return clicks.Total >= *u.MaxClicks, nil
+	}
+	return false, nil
+}
+
+// expirySweeper periodically archives links that have expired and drops
+// them from the Redis cache.
+func (us *URLShortener) expirySweeper(interval time.Duration) {
+	defer us.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-us.quit:
+			return
+		case <-ticker.C:
+			us.sweepExpired()
+		}
+	}
+}
+
+func (us *URLShortener) sweepExpired() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	archived, err := us.store.ArchiveExpired(ctx, time.Now().UTC())
+	if err != nil {
+		log.Printf("Error archiving expired links: %v", err)
+		return
+	}
+	if len(archived) == 0 {
+		return
+	}
+
+	keys := make([]string, len(archived))
+	for i, key := range archived {
+		keys[i] = cacheKey(key.Domain, key.ShortCode)
+	}
+	if err := us.redisClient.Del(ctx, keys...).Err(); err != nil {
+		log.Printf("Error evicting expired links from Redis: %v", err)
+	}
+	log.Printf("Archived %d expired links", len(archived))
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoIP looks up click locations in a local MaxMind-format database, such as
+// GeoLite2-City or GeoLite2-Country. A nil *geoIP finds nothing, so callers
+// need not check whether a database is configured.
+type geoIP struct {
+	db *maxminddb.Reader
+}
+
+// geoRecord holds the fields we read from City and Country databases.
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+}
+
+// GeoLocation is where a click came from. Region is an ISO 3166-2 code such
+// as "US-CA"; fields the database does not know are empty.
+type GeoLocation struct {
+	Country string
+	Region  string
+	City    string
+}
+
+// openGeoIP opens the database at path. It returns nil without an error
+// when no path is configured or the file does not exist, so geo enrichment
+// is simply skipped.
+func openGeoIP(path string) (*geoIP, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		log.Printf("GeoIP database %s not found, clicks will not be geolocated", path)
+		return nil, nil
+	}
+
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening GeoIP database: %w", err)
+	}
+	log.Printf("Loaded GeoIP database %s (%s)", path, db.Metadata.DatabaseType)
+	return &geoIP{db: db}, nil
+}
+
+func (g *geoIP) Lookup(ipAddress string) GeoLocation {
+	if g == nil {
+		return GeoLocation{}
+	}
+	ip := parseClientIP(ipAddress)
+	if ip == nil || (ip.To4() == nil && g.db.Metadata.IPVersion == 4) {
+		return GeoLocation{}
+	}
+
+	var record geoRecord
+	if err := g.db.Lookup(ip, &record); err != nil {
+		log.Printf("Error looking up %s in GeoIP database: %v", ip, err)
+		return GeoLocation{}
+	}
+
+	loc := GeoLocation{Country: record.Country.ISOCode, City: record.City.Names["en"]}
+	if len(record.Subdivisions) > 0 && record.Subdivisions[0].ISOCode != "" && loc.Country != "" {
+		loc.Region = loc.Country + "-" + record.Subdivisions[0].ISOCode
+	}
+	return loc
+}
+
+func (g *geoIP) Close() error {
+	if g == nil {
+		return nil
+	}
+	return g.db.Close()
+}
+
+// parseClientIP parses the client address recorded for a click, which is
+// either a bare IP from X-Forwarded-For or a host:port from RemoteAddr.
+func parseClientIP(address string) net.IP {
+	address = strings.TrimSpace(address)
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	return net.ParseIP(address)
+}
+
+// enrichEvent adds the location of the event's client IP.
+func (us *URLShortener) enrichEvent(event *AnalyticsEvent) {
+	loc := us.geo.Lookup(event.IPAddress)
+	event.Country, event.Region, event.City = loc.Country, loc.Region, loc.City
+}
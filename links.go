@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var ErrInvalidUpdate = errors.New("invalid update")
+
+// applyLinkPatch applies a PATCH /api/links body to u. Fields that are absent
+// are left alone; every field but long_url may be set to null to clear it,
+// which for redirect_type means using the global default.
+func applyLinkPatch(u *URL, patch map[string]json.RawMessage) error {
+	for field, raw := range patch {
+		isNull := string(raw) == "null"
+
+		switch field {
+		case "long_url":
+			var longURL string
+			if err := json.Unmarshal(raw, &longURL); err != nil || !isValidURL(longURL) {
+				return fmt.Errorf("%w: invalid URL format", ErrInvalidUpdate)
+			}
+			u.LongURL = longURL
+		case "title":
+			var title string
+			if !isNull {
+				if err := json.Unmarshal(raw, &title); err != nil {
+					return fmt.Errorf("%w: title must be a string", ErrInvalidUpdate)
+				}
+			}
+			if err := validateTitle(title); err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidUpdate, err)
+			}
+			u.Title = title
+		case "expires_at":
+			if isNull {
+				u.ExpiresAt = nil
+				continue
+			}
+			var expiresAt time.Time
+			if err := json.Unmarshal(raw, &expiresAt); err != nil {
+				return fmt.Errorf("%w: expires_at must be an RFC 3339 timestamp", ErrInvalidUpdate)
+			}
+			expiresAt = expiresAt.UTC()
+			u.ExpiresAt = &expiresAt
+		case "max_clicks":
+			if isNull {
+				u.MaxClicks = nil
+				continue
+			}
+			var maxClicks int
+			if err := json.Unmarshal(raw, &maxClicks); err != nil || maxClicks <= 0 {
+				return fmt.Errorf("%w: max_clicks must be positive", ErrInvalidUpdate)
+			}
+			u.MaxClicks = &maxClicks
+		case "redirect_type":
+			if isNull {
+				u.RedirectType = 0
+				continue
+			}
+			var redirectType int
+			if err := json.Unmarshal(raw, &redirectType); err != nil {
+				return fmt.Errorf("%w: redirect_type must be a number", ErrInvalidUpdate)
+			}
+			if err := validateRedirectType(redirectType); err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidUpdate, err)
+			}
+			u.RedirectType = redirectType
+		case "active_from", "active_until":
+			target := &u.ActiveFrom
+			if field == "active_until" {
+				target = &u.ActiveUntil
+			}
+			if isNull {
+				*target = nil
+				continue
+			}
+			var t time.Time
+			if err := json.Unmarshal(raw, &t); err != nil {
+				return fmt.Errorf("%w: %s must be an RFC 3339 timestamp", ErrInvalidUpdate, field)
+			}
+			t = t.UTC()
+			*target = &t
+		case "fallback_url":
+			if isNull {
+				u.FallbackURL = ""
+				continue
+			}
+			if err := json.Unmarshal(raw, &u.FallbackURL); err != nil {
+				return fmt.Errorf("%w: invalid fallback_url format", ErrInvalidUpdate)
+			}
+		case "targets":
+			var targets []TargetRule
+			if !isNull {
+				if err := json.Unmarshal(raw, &targets); err != nil {
+					return fmt.Errorf("%w: targets must be a list of targeting rules", ErrInvalidUpdate)
+				}
+			}
+			if err := normalizeTargetRules(targets); err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidUpdate, err)
+			}
+			u.Targets = targets
+		case "variants":
+			var variants []Variant
+			if !isNull {
+				if err := json.Unmarshal(raw, &variants); err != nil {
+					return fmt.Errorf("%w: variants must be a list of destinations", ErrInvalidUpdate)
+				}
+			}
+			if err := normalizeVariants(variants); err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidUpdate, err)
+			}
+			u.Variants = variants
+		case "query_forwarding":
+			var mode string
+			if !isNull {
+				if err := json.Unmarshal(raw, &mode); err != nil {
+					return fmt.Errorf("%w: query_forwarding must be a string", ErrInvalidUpdate)
+				}
+			}
+			if err := validateQueryForwarding(mode); err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidUpdate, err)
+			}
+			u.QueryForwarding = mode
+		case "utm_source", "utm_medium", "utm_campaign":
+			target := &u.UTMSource
+			switch field {
+			case "utm_medium":
+				target = &u.UTMMedium
+			case "utm_campaign":
+				target = &u.UTMCampaign
+			}
+			var template string
+			if !isNull {
+				if err := json.Unmarshal(raw, &template); err != nil {
+					return fmt.Errorf("%w: %s must be a string", ErrInvalidUpdate, field)
+				}
+			}
+			if err := validateUTMTemplate(field, template); err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidUpdate, err)
+			}
+			*target = template
+		case "password":
+			if isNull {
+				u.setPasswordHash("")
+				continue
+			}
+			var password string
+			if err := json.Unmarshal(raw, &password); err != nil {
+				return fmt.Errorf("%w: password must be a string", ErrInvalidUpdate)
+			}
+			hash, err := hashLinkPassword(password)
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidUpdate, err)
+			}
+			u.setPasswordHash(hash)
+		default:
+			return fmt.Errorf("%w: field %q cannot be updated", ErrInvalidUpdate, field)
+		}
+	}
+	if err := validateActiveWindow(u); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidUpdate, err)
+	}
+	return nil
+}
+
+// getOwnedURL loads a link from the store, hiding links that belong to
+// another owner behind ErrNotFound.
+func (us *URLShortener) getOwnedURL(ctx context.Context, ownerID, domain, shortCode string) (*URL, error) {
+	u, err := us.store.GetURL(ctx, domain, shortCode)
+	if err != nil {
+		return nil, err
+	}
+	if u.OwnerID != ownerID {
+		return nil, ErrNotFound
+	}
+	return u, nil
+}
+
+func (us *URLShortener) UpdateLink(ctx context.Context, ownerID, domain, shortCode string, patch map[string]json.RawMessage) (*URL, error) {
+	u, err := us.getOwnedURL(ctx, ownerID, domain, shortCode)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := applyLinkPatch(u, patch); err != nil {
+		return nil, err
+	}
+	if err := us.validator.CheckLink(u); err != nil {
+		return nil, err
+	}
+	// The sweeper re-archives the link if it is still expired after the update.
+	u.ArchivedAt = nil
+
+	updated, err := us.store.UpdateURL(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	// The destinations passed the threat list check above.
+	if updated.FlaggedAt != nil && us.threats.Loaded() {
+		if err := us.store.FlagURL(ctx, domain, shortCode, nil); err != nil {
+			return nil, err
+		}
+		updated.FlaggedAt = nil
+	}
+
+	us.invalidateURL(ctx, domain, shortCode)
+	return updated, nil
+}
+
+func (us *URLShortener) DisableLink(ctx context.Context, ownerID, domain, shortCode string) (*URL, error) {
+	u, err := us.getOwnedURL(ctx, ownerID, domain, shortCode)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.DisabledAt == nil {
+		now := time.Now().UTC()
+		u.DisabledAt = &now
+		if u, err = us.store.UpdateURL(ctx, u); err != nil {
+			return nil, err
+		}
+	}
+
+	us.invalidateURL(ctx, domain, shortCode)
+	return u, nil
+}
+
+func (us *URLShortener) DeleteLink(ctx context.Context, ownerID, domain, shortCode string) error {
+	if _, err := us.getOwnedURL(ctx, ownerID, domain, shortCode); err != nil {
+		return err
+	}
+	if err := us.store.DeleteURL(ctx, domain, shortCode, time.Now().UTC()); err != nil {
+		return err
+	}
+
+	us.invalidateURL(ctx, domain, shortCode)
+	return nil
+}
+
+func (us *URLShortener) invalidateURL(ctx context.Context, domain, shortCode string) {
+	if err := us.redisClient.Del(ctx, cacheKey(domain, shortCode)).Err(); err != nil {
+		log.Printf("Error evicting %s from Redis: %v", shortCode, err)
+	}
+}
+
+func writeLinkError(w http.ResponseWriter, ctx context.Context, err error) {
+	if ctx.Err() == context.DeadlineExceeded {
+		http.Error(w, "Request timeout", http.StatusRequestTimeout)
+		return
+	}
+	if err == ErrNotFound {
+		http.Error(w, "Short URL not found", http.StatusNotFound)
+		return
+	}
+	var urlErr *URLError
+	if errors.Is(err, ErrInvalidUpdate) || errors.As(err, &urlErr) || err == ErrUnknownDomain {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, "Error updating link", http.StatusInternalServerError)
+}
+
+func (us *URLShortener) updateLinkHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var patch map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	domain, err := us.requestDomain(r)
+	if err != nil {
+		writeLinkError(w, ctx, err)
+		return
+	}
+
+	urlRecord, err := us.UpdateLink(ctx, ownerFromContext(ctx), domain, mux.Vars(r)["shortCode"], patch)
+	if err != nil {
+		writeLinkError(w, ctx, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(urlRecord)
+}
+
+func (us *URLShortener) disableLinkHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	domain, err := us.requestDomain(r)
+	if err != nil {
+		writeLinkError(w, ctx, err)
+		return
+	}
+
+	urlRecord, err := us.DisableLink(ctx, ownerFromContext(ctx), domain, mux.Vars(r)["shortCode"])
+	if err != nil {
+		writeLinkError(w, ctx, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(urlRecord)
+}
+
+func (us *URLShortener) deleteLinkHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	domain, err := us.requestDomain(r)
+	if err != nil {
+		writeLinkError(w, ctx, err)
+		return
+	}
+
+	if err := us.DeleteLink(ctx, ownerFromContext(ctx), domain, mux.Vars(r)["shortCode"]); err != nil {
+		writeLinkError(w, ctx, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
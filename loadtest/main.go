@@ -59,6 +59,10 @@ func (lt *LoadTester) makeRequest(method, url string, body []byte, headers map[s
 		return nil, 0, err
 	}
 
+	if apiKey := os.Getenv("LOADTEST_API_KEY"); apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+
 	for key, value := range headers {
 		req.Header.Set(key, value)
 	}
@@ -305,9 +309,9 @@ func (lt *LoadTester) testStats() (bool, time.Duration, error) {
 }
 
 func printResults(results []TestResult) {
-	fmt.Println("\n")
+	fmt.Print("\n\n")
 	fmt.Println("LOAD TEST RESULTS SUMMARY")
-	fmt.Println("\n")
+	fmt.Print("\n\n")
 
 	totalRequests := 0
 	totalSuccess := 0
@@ -340,7 +344,7 @@ func printResults(results []TestResult) {
 		totalErrors += result.ErrorCount
 	}
 
-	fmt.Println("\n")
+	fmt.Print("\n\n")
 	fmt.Println("OVERALL SUMMARY:")
 	fmt.Printf("   Total Requests: %d\n", totalRequests)
 	fmt.Printf("   Total Successful: %d (%.1f%%)\n", totalSuccess,
@@ -3,30 +3,61 @@ package main
 import (
 	"context"
 	"crypto/rand"
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
 	"math/big"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
 )
 
 type URL struct {
-	ID        int       `json:"id"`
-	ShortCode string    `json:"short_code"`
-	LongURL   string    `json:"long_url"`
-	Clicks    int       `json:"clicks"`
-	CreatedAt time.Time `json:"created_at"`
+	ID           int          `json:"id"`
+	ShortCode    string       `json:"short_code"`
+	LongURL      string       `json:"long_url"`
+	Title        string       `json:"title,omitempty"`
+	Clicks       int          `json:"clicks"`
+	CreatedAt    time.Time    `json:"created_at"`
+	ExpiresAt    *time.Time   `json:"expires_at,omitempty"`
+	MaxClicks    *int         `json:"max_clicks,omitempty"`
+	ArchivedAt   *time.Time   `json:"archived_at,omitempty"`
+	DisabledAt   *time.Time   `json:"disabled_at,omitempty"`
+	OwnerID      string       `json:"owner_id,omitempty"`
+	Domain       string       `json:"domain,omitempty"`
+	RedirectType int          `json:"redirect_type,omitempty"`
+	SingleUse    bool         `json:"single_use,omitempty"`
+	ConsumedAt   *time.Time   `json:"consumed_at,omitempty"`
+	FlaggedAt    *time.Time   `json:"flagged_at,omitempty"`
+	ActiveFrom   *time.Time   `json:"active_from,omitempty"`
+	ActiveUntil  *time.Time   `json:"active_until,omitempty"`
+	FallbackURL  string       `json:"fallback_url,omitempty"`
+	Targets      []TargetRule `json:"targets,omitempty"`
+	Variants     []Variant    `json:"variants,omitempty"`
+
+	QueryForwarding string `json:"query_forwarding,omitempty"`
+	UTMSource       string `json:"utm_source,omitempty"`
+	UTMMedium       string `json:"utm_medium,omitempty"`
+	UTMCampaign     string `json:"utm_campaign,omitempty"`
+
+	// PasswordHash is never serialized, so the Redis cache only knows
+	// that a link is protected; passwords are checked against the store.
+	// PasswordVersion changes with the hash and is signed into access
+	// cookies, so changing the password revokes them. All three are set
+	// by setPasswordHash.
+	PasswordHash      string `json:"-"`
+	PasswordProtected bool   `json:"password_protected,omitempty"`
+	PasswordVersion   string `json:"password_version,omitempty"`
 }
 
 type AnalyticsRecord struct {
@@ -34,112 +65,187 @@ type AnalyticsRecord struct {
 	ShortCode string    `json:"short_code"`
 	IPAddress string    `json:"ip_address"`
 	UserAgent string    `json:"user_agent"`
+	Referrer  string    `json:"referrer"`
+	Language  string    `json:"language"`
+	Browser   string    `json:"browser"`
+	OS        string    `json:"os"`
+	Device    string    `json:"device"`
+	IsBot     bool      `json:"is_bot"`
+	Country   string    `json:"country"`
+	Region    string    `json:"region"`
+	City      string    `json:"city"`
 	Timestamp time.Time `json:"timestamp"`
+
+	TargetRule string `json:"target_rule,omitempty"`
+	Variant    string `json:"variant,omitempty"`
+}
+
+// ShortenOptions carries the optional fields accepted by POST /api/shorten.
+type ShortenOptions struct {
+	OwnerID      string
+	Domain       string
+	Alias        string
+	Title        string
+	ExpiresAt    *time.Time
+	MaxClicks    *int
+	RedirectType int
+	Password     string
+	SingleUse    bool
+	ActiveFrom   *time.Time
+	ActiveUntil  *time.Time
+	FallbackURL  string
+	Targets      []TargetRule
+	Variants     []Variant
+
+	QueryForwarding string
+	UTMSource       string
+	UTMMedium       string
+	UTMCampaign     string
+
+	// passwordHash is the hash of Password, filled in by ShortenURL.
+	passwordHash string
 }
 
+// AnalyticsEvent is one redirect as captured by redirectHandler. The
+// User-Agent is parsed and classified when the event is queued, so the
+// Browser, OS, Device and IsBot fields are stored alongside the raw string. The location fields
+// and IP anonymization are applied by prepareEvents, which sets Prepared.
 type AnalyticsEvent struct {
-	ShortCode string
-	IPAddress string
-	UserAgent string
-	Timestamp time.Time
+	Domain         string
+	ShortCode      string
+	IPAddress      string
+	UserAgent      string
+	Referrer       string
+	ReferrerDomain string
+	Language       string
+	Browser        string
+	OS             string
+	Device         string
+	IsBot          bool
+	Country        string
+	Region         string
+	City           string
+	Timestamp      time.Time
+	TargetRule     string
+	Variant        string
+	VisitorHash    string
+	Prepared       bool
 }
 
 type URLShortener struct {
-	db               *sql.DB
+	cfg              *Config
+	store            Store
 	analyticsChannel chan AnalyticsEvent
 	redisClient      *redis.Client
+	spill            *spillLog
+	clicks           clickCounter
+	uniques          *uniqueCounter
+	geo              *geoIP
+	bots             *botClassifier
+	validator        *urlValidator
+	threats          *threatList
+	cookieSecret     []byte
+	visitorKey       []byte
+	quit             chan struct{}
 	wg               sync.WaitGroup
-}
 
-func NewURLShortener(dbURL string, redisAddr string) (*URLShortener, error) {
-	db, err := sql.Open("postgres", dbURL)
-	if err != nil {
-		return nil, err
-	}
-
-	if err := db.Ping(); err != nil {
-		return nil, fmt.Errorf("failed to ping database: %w", err)
-	}
+	// closeMu guards sends on analyticsChannel against Close closing it.
+	closeMu sync.RWMutex
+	closed  bool
 
-	db.SetMaxOpenConns(50)
-	db.SetMaxIdleConns(15)
-	db.SetConnMaxLifetime(10 * time.Minute)
+	// flushCtx is used for writing analytics batches. Close cancels it once
+	// AnalyticsFlushTimeout has passed so the final flush cannot hang.
+	flushCtx    context.Context
+	cancelFlush context.CancelFunc
+}
 
+func NewURLShortener(cfg *Config, store Store) (*URLShortener, error) {
 	rdb := redis.NewClient(&redis.Options{
-		Addr:     redisAddr,
+		Addr:     cfg.RedisAddr,
 		Password: "",
 		DB:       0,
 	})
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	_, err = rdb.Ping(ctx).Result()
+	_, err := rdb.Ping(ctx).Result()
 	if err != nil {
 		return nil, fmt.Errorf("failed to ping Redis: %w", err)
 	}
 
 	us := &URLShortener{
-		db:               db,
+		cfg:              cfg,
+		store:            store,
 		analyticsChannel: make(chan AnalyticsEvent, 1000),
 		redisClient:      rdb,
+		clicks:           newClickCounter(cfg, rdb),
+		uniques:          newUniqueCounter(rdb),
+		quit:             make(chan struct{}),
 	}
+	us.flushCtx, us.cancelFlush = context.WithCancel(context.Background())
 
-	if err := us.createTables(); err != nil {
+	if err := store.Migrate(ctx); err != nil {
 		return nil, err
 	}
 
-	go us.analyticsWorker()
-
-	return us, nil
-}
+	if us.spill, err = openSpillLog(cfg.SpillDir); err != nil {
+		return nil, err
+	}
 
-func (us *URLShortener) createTables() error {
+	if us.geo, err = openGeoIP(cfg.GeoIPDBPath); err != nil {
+		return nil, err
+	}
 
-	urlsTable := `
-	CREATE TABLE IF NOT EXISTS urls (
-		id SERIAL PRIMARY KEY,
-		short_code TEXT UNIQUE NOT NULL,
-		long_url TEXT NOT NULL,
-		clicks INTEGER DEFAULT 0,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);`
+	if us.bots, err = newBotClassifier(cfg.BotRulesFile); err != nil {
+		return nil, err
+	}
 
-	analyticsTable := `
-	CREATE TABLE IF NOT EXISTS analytics (
-		id SERIAL PRIMARY KEY,
-		short_code TEXT NOT NULL,
-		ip_address TEXT,
-		user_agent TEXT,
-		timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		FOREIGN KEY (short_code) REFERENCES urls(short_code)
-	);`
+	us.threats = openThreatList(cfg.ThreatListSource)
+	if us.validator, err = newURLValidator(cfg, us.threats); err != nil {
+		return nil, err
+	}
 
-	indexQueries := []string{
-		`CREATE INDEX IF NOT EXISTS idx_urls_short_code ON urls(short_code);`,
-		`CREATE INDEX IF NOT EXISTS idx_urls_created_at ON urls(created_at DESC);`,
-		`CREATE INDEX IF NOT EXISTS idx_urls_long_url ON urls(long_url);`,
-		`CREATE INDEX IF NOT EXISTS idx_analytics_short_code ON analytics(short_code);`,
-		`CREATE INDEX IF NOT EXISTS idx_analytics_timestamp ON analytics(timestamp DESC);`,
+	if us.cookieSecret, err = linkCookieSecret(cfg); err != nil {
+		return nil, err
 	}
 
-	if _, err := us.db.Exec(urlsTable); err != nil {
-		return err
+	if us.visitorKey, err = visitorHashKey(cfg); err != nil {
+		return nil, err
 	}
 
-	if _, err := us.db.Exec(analyticsTable); err != nil {
-		return err
+	us.wg.Add(1)
+	go us.analyticsWorker()
+
+	us.wg.Add(1)
+	go us.spillReplayer(cfg.SpillReplayInterval)
+
+	us.wg.Add(1)
+	go us.clickFlusher(cfg.ClickFlushInterval)
+
+	us.wg.Add(1)
+	go us.uniquesRetrier(uniquesRetryInterval)
+
+	if cfg.AnalyticsRetention > 0 {
+		us.wg.Add(1)
+		go us.retentionPruner(cfg.AnalyticsRetention, cfg.RetentionSweepInterval)
 	}
 
-	for _, query := range indexQueries {
-		if _, err := us.db.Exec(query); err != nil {
-			return fmt.Errorf("failed to create index: %w", err)
-		}
+	us.wg.Add(1)
+	go us.expirySweeper(cfg.ExpirySweepInterval)
+
+	if us.threats != nil {
+		us.wg.Add(1)
+		go us.threatRefresher(cfg.ThreatListRefreshInterval)
 	}
 
-	return nil
+	return us, nil
 }
 
+// analyticsWorker writes queued analytics events in batches. It runs until
+// the channel is closed, then flushes whatever is left and returns.
 func (us *URLShortener) analyticsWorker() {
+	defer us.wg.Done()
+
 	ticker := time.NewTicker(100 * time.Millisecond)
 	defer ticker.Stop()
 
@@ -147,7 +253,11 @@ func (us *URLShortener) analyticsWorker() {
 
 	for {
 		select {
-		case event := <-us.analyticsChannel:
+		case event, ok := <-us.analyticsChannel:
+			if !ok {
+				us.processBatch(batch)
+				return
+			}
 			batch = append(batch, event)
 			if len(batch) >= 50 {
 				us.processBatch(batch)
@@ -162,44 +272,21 @@ func (us *URLShortener) analyticsWorker() {
 	}
 }
 
+// recordEvents prepares a batch of events and writes it to the store.
+func (us *URLShortener) recordEvents(ctx context.Context, events []AnalyticsEvent) error {
+	us.prepareEvents(events)
+	us.uniques.Add(ctx, events)
+	return us.store.RecordEvents(ctx, events)
+}
+
 func (us *URLShortener) processBatch(events []AnalyticsEvent) {
 	if len(events) == 0 {
 		return
 	}
 
-	tx, err := us.db.Begin()
-	if err != nil {
-		log.Printf("Error starting analytics transaction: %v", err)
-		return
-	}
-	defer tx.Rollback()
-
-	updateStmt, err := tx.Prepare("UPDATE urls SET clicks = clicks + 1 WHERE short_code = $1")
-	if err != nil {
-		log.Printf("Error preparing update statement: %v", err)
-		return
-	}
-	defer updateStmt.Close()
-
-	insertStmt, err := tx.Prepare("INSERT INTO analytics (short_code, ip_address, user_agent, timestamp) VALUES ($1, $2, $3, $4)")
-	if err != nil {
-		log.Printf("Error preparing insert statement: %v", err)
-		return
-	}
-	defer insertStmt.Close()
-
-	for _, event := range events {
-		if _, err := updateStmt.Exec(event.ShortCode); err != nil {
-			log.Printf("Error updating clicks for %s: %v", event.ShortCode, err)
-			continue
-		}
-
-		if _, err := insertStmt.Exec(event.ShortCode, event.IPAddress, event.UserAgent, event.Timestamp); err != nil {
-			log.Printf("Error inserting analytics for %s: %v", event.ShortCode, err)
-		}
-	}
-	if err := tx.Commit(); err != nil {
-		log.Printf("Error committing analytics batch: %v", err)
+	if err := us.recordEvents(us.flushCtx, events); err != nil {
+		log.Printf("Error recording analytics batch of %d events, spilling to disk: %v", len(events), err)
+		us.spillEvents(events...)
 	}
 }
 
@@ -217,7 +304,7 @@ func generateShortCode(length int) (string, error) {
 	return string(result), nil
 }
 
-func (us *URLShortener) generateUniqueShortCode(ctx context.Context) (string, error) {
+func (us *URLShortener) generateUniqueShortCode(ctx context.Context, domain string) (string, error) {
 	maxAttempts := 10
 	startLength := 6
 
@@ -228,12 +315,15 @@ func (us *URLShortener) generateUniqueShortCode(ctx context.Context) (string, er
 				return "", err
 			}
 
-			var count int
-			err = us.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM urls WHERE short_code = $1", shortCode).Scan(&count)
+			if isReservedAlias(shortCode) {
+				continue
+			}
+
+			exists, err := us.store.ShortCodeExists(ctx, domain, shortCode)
 			if err != nil {
 				return "", err
 			}
-			if count == 0 {
+			if !exists {
 				return shortCode, nil
 			}
 		}
@@ -241,50 +331,181 @@ func (us *URLShortener) generateUniqueShortCode(ctx context.Context) (string, er
 	return "", fmt.Errorf("failed to generate unique short code after multiple attempts")
 }
 
+// isValidURL only checks that str is an absolute URL; destinations are also
+// checked against the rules of urlValidator.
 func isValidURL(str string) bool {
 	u, err := url.Parse(str)
 	return err == nil && u.Scheme != "" && u.Host != ""
 }
 
-func (us *URLShortener) ShortenURL(ctx context.Context, longURL string) (*URL, error) {
-	if !isValidURL(longURL) {
-		return nil, fmt.Errorf("invalid URL format")
+func (us *URLShortener) ShortenURL(ctx context.Context, longURL string, opts ShortenOptions) (*URL, error) {
+	if opts.ExpiresAt != nil && !opts.ExpiresAt.After(time.Now()) {
+		return nil, fmt.Errorf("expires_at must be in the future")
+	}
+	if opts.MaxClicks != nil && *opts.MaxClicks <= 0 {
+		return nil, fmt.Errorf("max_clicks must be positive")
+	}
+	if opts.RedirectType != 0 {
+		if err := validateRedirectType(opts.RedirectType); err != nil {
+			return nil, err
+		}
+	}
+	if opts.ActiveUntil != nil && !opts.ActiveUntil.After(time.Now()) {
+		return nil, fmt.Errorf("active_until must be in the future")
+	}
+	if err := validateActiveWindow(&URL{ActiveFrom: opts.ActiveFrom, ActiveUntil: opts.ActiveUntil, FallbackURL: opts.FallbackURL}); err != nil {
+		return nil, err
+	}
+	if err := normalizeTargetRules(opts.Targets); err != nil {
+		return nil, err
+	}
+	if err := normalizeVariants(opts.Variants); err != nil {
+		return nil, err
+	}
+	if err := us.validator.CheckLink(&URL{LongURL: longURL, FallbackURL: opts.FallbackURL, Targets: opts.Targets, Variants: opts.Variants}); err != nil {
+		return nil, err
+	}
+	if err := validateTitle(opts.Title); err != nil {
+		return nil, err
+	}
+	if err := validateQueryForwarding(opts.QueryForwarding); err != nil {
+		return nil, err
+	}
+	if err := validateUTMTemplates(&URL{UTMSource: opts.UTMSource, UTMMedium: opts.UTMMedium, UTMCampaign: opts.UTMCampaign}); err != nil {
+		return nil, err
+	}
+	if opts.Password != "" {
+		var err error
+		if opts.passwordHash, err = hashLinkPassword(opts.Password); err != nil {
+			return nil, err
+		}
 	}
 
-	var existingURL URL
-	err := us.db.QueryRowContext(ctx,
-		"SELECT id, short_code, long_url, clicks, created_at FROM urls WHERE long_url = $1",
-		longURL).Scan(&existingURL.ID, &existingURL.ShortCode, &existingURL.LongURL, &existingURL.Clicks, &existingURL.CreatedAt)
+	if opts.Alias != "" {
+		return us.shortenWithAlias(ctx, longURL, opts)
+	}
 
-	if err == nil {
-		urlJSON, _ := json.Marshal(existingURL)
-		us.redisClient.Set(ctx, existingURL.ShortCode, urlJSON, 24*time.Hour)
-		return &existingURL, nil
+	// Only plain links are deduplicated; a link with its own lifetime or
+	// redirect type must not be handed out to callers asking for a plain
+	// one, or vice versa.
+	if opts.Title == "" && opts.ExpiresAt == nil && opts.MaxClicks == nil && opts.RedirectType == 0 && opts.Password == "" && !opts.SingleUse &&
+		opts.ActiveFrom == nil && opts.ActiveUntil == nil && opts.FallbackURL == "" &&
+		len(opts.Targets) == 0 && len(opts.Variants) == 0 &&
+		opts.QueryForwarding == "" && opts.UTMSource == "" && opts.UTMMedium == "" && opts.UTMCampaign == "" {
+		existingURL, err := us.store.FindByLongURL(ctx, opts.OwnerID, opts.Domain, longURL)
+		if err == nil {
+			us.cacheURL(ctx, existingURL)
+			return existingURL, nil
+		} else if err != ErrNotFound {
+			return nil, err
+		}
+	}
 
+	shortCode, err := us.generateUniqueShortCode(ctx, opts.Domain)
+	if err != nil {
+		return nil, err
 	}
 
-	shortCode, err := us.generateUniqueShortCode(ctx)
+	newURL, err := us.store.CreateURL(ctx, newURLRecord(shortCode, longURL, opts))
 	if err != nil {
 		return nil, err
 	}
 
-	var newURL URL
-	err = us.db.QueryRowContext(ctx,
-		"INSERT INTO urls (short_code, long_url) VALUES ($1, $2) RETURNING id, short_code, long_url, clicks, created_at",
-		shortCode, longURL,
-	).Scan(&newURL.ID, &newURL.ShortCode, &newURL.LongURL, &newURL.Clicks, &newURL.CreatedAt)
+	us.cacheURL(ctx, newURL)
+	return newURL, nil
+}
+
+func newURLRecord(shortCode, longURL string, opts ShortenOptions) *URL {
+	u := &URL{
+		ShortCode:    shortCode,
+		LongURL:      longURL,
+		Title:        opts.Title,
+		MaxClicks:    opts.MaxClicks,
+		OwnerID:      opts.OwnerID,
+		Domain:       opts.Domain,
+		RedirectType: opts.RedirectType,
+		PasswordHash: opts.passwordHash,
+		SingleUse:    opts.SingleUse,
+		FallbackURL:  opts.FallbackURL,
+		Targets:      opts.Targets,
+		Variants:     opts.Variants,
+
+		QueryForwarding: opts.QueryForwarding,
+		UTMSource:       opts.UTMSource,
+		UTMMedium:       opts.UTMMedium,
+		UTMCampaign:     opts.UTMCampaign,
+	}
+	if opts.ExpiresAt != nil {
+		expiresAt := opts.ExpiresAt.UTC()
+		u.ExpiresAt = &expiresAt
+	}
+	if opts.ActiveFrom != nil {
+		activeFrom := opts.ActiveFrom.UTC()
+		u.ActiveFrom = &activeFrom
+	}
+	if opts.ActiveUntil != nil {
+		activeUntil := opts.ActiveUntil.UTC()
+		u.ActiveUntil = &activeUntil
+	}
+	return u
+}
+
+// shortenWithAlias stores longURL under a caller-chosen short code. Asking for
+// an alias the caller already points at the same URL is idempotent; any other
+// existing use of the alias yields ErrAliasTaken.
+func (us *URLShortener) shortenWithAlias(ctx context.Context, longURL string, opts ShortenOptions) (*URL, error) {
+	alias := opts.Alias
+	if err := validateAlias(alias); err != nil {
+		return nil, err
+	}
 
+	newURL, err := us.store.CreateURL(ctx, newURLRecord(alias, longURL, opts))
+	if err == ErrShortCodeTaken {
+		existingURL, getErr := us.store.GetURL(ctx, opts.Domain, alias)
+		if getErr == ErrNotFound {
+			// Deleted links keep their short code so analytics stay attached.
+			return nil, ErrAliasTaken
+		}
+		if getErr != nil {
+			return nil, getErr
+		}
+		if existingURL.LongURL != longURL || existingURL.OwnerID != opts.OwnerID ||
+			existingURL.SingleUse != opts.SingleUse || !samePassword(existingURL, opts.Password) {
+			return nil, ErrAliasTaken
+		}
+		newURL, err = existingURL, nil
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	newURLJSON, _ := json.Marshal(newURL)
-	us.redisClient.Set(ctx, newURL.ShortCode, newURLJSON, 24*time.Hour)
-	return &newURL, nil
+	us.cacheURL(ctx, newURL)
+	return newURL, nil
+}
+
+// cacheURL stores u in Redis for up to a day, never outliving the link itself
+// nor past the next boundary of its activation window.
+func (us *URLShortener) cacheURL(ctx context.Context, u *URL) {
+	ttl := 24 * time.Hour
+	if u.ExpiresAt != nil {
+		remaining := time.Until(*u.ExpiresAt)
+		if remaining <= 0 {
+			return
+		}
+		if remaining < ttl {
+			ttl = remaining
+		}
+	}
+	if remaining, ok := nextWindowBoundary(u, time.Now()); ok && remaining < ttl {
+		ttl = remaining
+	}
+
+	urlJSON, _ := json.Marshal(u)
+	us.redisClient.Set(ctx, cacheKey(u.Domain, u.ShortCode), urlJSON, ttl)
 }
 
-func (us *URLShortener) GetURL(ctx context.Context, shortCode string) (*URL, error) {
-	cachedURLJSON, err := us.redisClient.Get(ctx, shortCode).Result()
+func (us *URLShortener) GetURL(ctx context.Context, domain, shortCode string) (*URL, error) {
+	cachedURLJSON, err := us.redisClient.Get(ctx, cacheKey(domain, shortCode)).Result()
 	if err == nil {
 		var urlRecord URL
 		jsonErr := json.Unmarshal([]byte(cachedURLJSON), &urlRecord)
@@ -296,62 +517,49 @@ func (us *URLShortener) GetURL(ctx context.Context, shortCode string) (*URL, err
 		log.Printf("Error getting from Redis for %s: %v", shortCode, err)
 	}
 
-	var urlRecord URL
-	err = us.db.QueryRowContext(ctx,
-		"SELECT id, short_code, long_url, clicks, created_at FROM urls WHERE short_code = $1",
-		shortCode).Scan(&urlRecord.ID, &urlRecord.ShortCode, &urlRecord.LongURL, &urlRecord.Clicks, &urlRecord.CreatedAt)
-
+	urlRecord, err := us.store.GetURL(ctx, domain, shortCode)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("short URL not found")
-		}
 		return nil, err
 	}
 
-	urlJSON, _ := json.Marshal(urlRecord)
-	us.redisClient.Set(ctx, shortCode, urlJSON, 24*time.Hour)
-	return &urlRecord, nil
+	us.cacheURL(ctx, urlRecord)
+	return urlRecord, nil
 }
 
-func (us *URLShortener) RecordAnalytics(shortCode, ipAddress, userAgent string) {
-	event := AnalyticsEvent{
-		ShortCode: shortCode,
-		IPAddress: ipAddress,
-		UserAgent: userAgent,
-		Timestamp: time.Now(),
+// RecordAnalytics queues the analytics event of a redirect. The caller sets
+// the link, client address and what the redirect decided; the request
+// headers are read here.
+func (us *URLShortener) RecordAnalytics(r *http.Request, event AnalyticsEvent) {
+	ua := parseUserAgent(r.UserAgent())
+	if event.IsBot {
+		ua.Device = deviceBot
+	}
+	event.UserAgent = r.UserAgent()
+	event.Referrer = r.Referer()
+	event.ReferrerDomain = referrerDomain(r.Referer())
+	event.Language = primaryLanguage(r.Header.Get("Accept-Language"))
+	event.Browser, event.OS, event.Device = ua.Browser, ua.OS, ua.Device
+	event.Timestamp = time.Now().UTC()
+
+	us.closeMu.RLock()
+	defer us.closeMu.RUnlock()
+	if us.closed {
+		us.spillEvents(event)
+		return
 	}
 
 	select {
 	case us.analyticsChannel <- event:
 		//successful enqueueing
 	default:
-		//channel is full, drop (later add some fallback here)
-		log.Printf("Analytics channel full, dropping event for %s", shortCode)
+		//channel is full, keep the event on disk until the store catches up
+		us.spillEvents(event)
 	}
 
 }
 
-func (us *URLShortener) GetAnalytics(ctx context.Context, shortCode string) ([]AnalyticsRecord, error) {
-	rows, err := us.db.QueryContext(ctx,
-		"SELECT id, short_code, ip_address, user_agent, timestamp FROM analytics WHERE short_code = $1 ORDER BY timestamp DESC LIMIT 1000",
-		shortCode)
-
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var analytics []AnalyticsRecord
-	for rows.Next() {
-		var record AnalyticsRecord
-		err := rows.Scan(&record.ID, &record.ShortCode, &record.IPAddress, &record.UserAgent, &record.Timestamp)
-		if err != nil {
-			return nil, err
-		}
-		analytics = append(analytics, record)
-	}
-
-	return analytics, rows.Err()
+func (us *URLShortener) GetAnalytics(ctx context.Context, domain, shortCode string) ([]AnalyticsRecord, error) {
+	return us.store.GetAnalytics(ctx, domain, shortCode, 1000)
 }
 
 //HTTP handlers
@@ -366,7 +574,25 @@ func (us *URLShortener) shortenHandler(w http.ResponseWriter, r *http.Request) {
 	defer cancel()
 
 	var request struct {
-		URL string `json:"url"`
+		URL          string       `json:"url"`
+		Alias        string       `json:"alias"`
+		Title        string       `json:"title"`
+		Domain       string       `json:"domain"`
+		ExpiresAt    *time.Time   `json:"expires_at"`
+		MaxClicks    *int         `json:"max_clicks"`
+		RedirectType int          `json:"redirect_type"`
+		Password     string       `json:"password"`
+		SingleUse    bool         `json:"single_use"`
+		ActiveFrom   *time.Time   `json:"active_from"`
+		ActiveUntil  *time.Time   `json:"active_until"`
+		FallbackURL  string       `json:"fallback_url"`
+		Targets      []TargetRule `json:"targets"`
+		Variants     []Variant    `json:"variants"`
+
+		QueryForwarding string `json:"query_forwarding"`
+		UTMSource       string `json:"utm_source"`
+		UTMMedium       string `json:"utm_medium"`
+		UTMCampaign     string `json:"utm_campaign"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
@@ -379,25 +605,124 @@ func (us *URLShortener) shortenHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	urlRecord, err := us.ShortenURL(ctx, request.URL)
+	domain := us.domainForHost(r.Host)
+	if request.Domain != "" {
+		var err error
+		if domain, err = us.resolveDomain(request.Domain); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	urlRecord, err := us.ShortenURL(ctx, request.URL, ShortenOptions{
+		OwnerID:      ownerFromContext(r.Context()),
+		Domain:       domain,
+		Alias:        request.Alias,
+		Title:        request.Title,
+		ExpiresAt:    request.ExpiresAt,
+		MaxClicks:    request.MaxClicks,
+		RedirectType: request.RedirectType,
+		Password:     request.Password,
+		SingleUse:    request.SingleUse,
+		ActiveFrom:   request.ActiveFrom,
+		ActiveUntil:  request.ActiveUntil,
+		FallbackURL:  request.FallbackURL,
+		Targets:      request.Targets,
+		Variants:     request.Variants,
+
+		QueryForwarding: request.QueryForwarding,
+		UTMSource:       request.UTMSource,
+		UTMMedium:       request.UTMMedium,
+		UTMCampaign:     request.UTMCampaign,
+	})
 	if err != nil {
 		if ctx.Err() == context.DeadlineExceeded {
 			http.Error(w, "Request timeout", http.StatusRequestTimeout)
 			return
 		}
+		if err == ErrAliasTaken {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"short_url":  fmt.Sprintf("http://localhost:8080/%s", urlRecord.ShortCode),
-		"short_code": urlRecord.ShortCode,
-		"long_url":   urlRecord.LongURL,
-		"created_at": urlRecord.CreatedAt,
+		"short_url":     us.shortURL(urlRecord),
+		"short_code":    urlRecord.ShortCode,
+		"long_url":      urlRecord.LongURL,
+		"title":         urlRecord.Title,
+		"created_at":    urlRecord.CreatedAt,
+		"expires_at":    urlRecord.ExpiresAt,
+		"max_clicks":    urlRecord.MaxClicks,
+		"redirect_type": us.redirectStatus(urlRecord),
+
+		"password_protected": urlRecord.PasswordProtected,
+		"single_use":         urlRecord.SingleUse,
+		"active_from":        urlRecord.ActiveFrom,
+		"active_until":       urlRecord.ActiveUntil,
+		"fallback_url":       urlRecord.FallbackURL,
+		"targets":            urlRecord.Targets,
+		"variants":           urlRecord.Variants,
+		"query_forwarding":   urlRecord.QueryForwarding,
+		"utm_source":         urlRecord.UTMSource,
+		"utm_medium":         urlRecord.UTMMedium,
+		"utm_campaign":       urlRecord.UTMCampaign,
 	})
 }
 
+// clientAddress returns where a request came from: the first
+// X-Forwarded-For entry, or else RemoteAddr.
+func clientAddress(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.Split(forwarded, ",")[0]
+	}
+	return r.RemoteAddr
+}
+
+// peerAddress returns the address of the client for rate limiting. Unlike
+// clientAddress it does not take X-Forwarded-For on trust: the header is
+// only read when RemoteAddr is one of TRUSTED_PROXIES, and then walked from
+// the right past further trusted proxies, so clients cannot choose the
+// address they are counted under.
+func (us *URLShortener) peerAddress(r *http.Request) string {
+	address := r.RemoteAddr
+	if !us.isTrustedProxy(parseClientIP(address)) {
+		return address
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		ip := parseClientIP(hop)
+		if ip == nil {
+			break
+		}
+		address = hop
+		if !us.isTrustedProxy(ip) {
+			break
+		}
+	}
+	return address
+}
+
+func (us *URLShortener) isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range us.cfg.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func (us *URLShortener) redirectHandler(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
 	defer cancel()
@@ -410,7 +735,9 @@ func (us *URLShortener) redirectHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	urlRecord, err := us.GetURL(ctx, shortCode)
+	domain := us.domainForHost(r.Host)
+
+	urlRecord, err := us.GetURL(ctx, domain, shortCode)
 	if err != nil {
 		if ctx.Err() == context.DeadlineExceeded {
 			http.Error(w, "Request timeout", http.StatusRequestTimeout)
@@ -420,15 +747,79 @@ func (us *URLShortener) redirectHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	ipAddress := r.RemoteAddr
-	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
-		ipAddress = strings.Split(forwarded, ",")[0]
+	if urlRecord.DisabledAt != nil {
+		http.Error(w, "Short URL has been disabled", http.StatusGone)
+		return
+	}
+	expired, err := us.isExpired(ctx, urlRecord)
+	if err != nil {
+		http.Error(w, "Error checking link status", http.StatusInternalServerError)
+		return
+	}
+	if expired {
+		http.Error(w, "Short URL has expired", http.StatusGone)
+		return
+	}
+	if urlRecord.ConsumedAt != nil {
+		http.Error(w, "Short URL has already been used", http.StatusGone)
+		return
+	}
+	if now := time.Now(); !isActiveAt(urlRecord, now) {
+		us.serveInactiveLink(w, r, urlRecord, now)
+		return
+	}
+
+	if urlRecord.PasswordProtected && !us.hasLinkAccess(r, urlRecord) {
+		us.renderPasswordForm(w, r, urlRecord, http.StatusUnauthorized, "")
+		return
+	}
+
+	if urlRecord.FlaggedAt != nil {
+		us.serveThreatWarning(w, urlRecord)
+		return
 	}
-	userAgent := r.UserAgent()
 
-	us.RecordAnalytics(shortCode, ipAddress, userAgent)
+	if urlRecord.SingleUse && us.bots.IsBot(r.UserAgent()) {
+		us.serveSingleUseNotice(w, urlRecord)
+		return
+	}
+	if urlRecord.SingleUse {
+		if err := us.consumeLink(ctx, urlRecord); err != nil {
+			switch {
+			case err == ErrLinkConsumed:
+				http.Error(w, "Short URL has already been used", http.StatusGone)
+			case err == ErrNotFound:
+				http.Error(w, "Short URL not found", http.StatusNotFound)
+			case ctx.Err() == context.DeadlineExceeded:
+				http.Error(w, "Request timeout", http.StatusRequestTimeout)
+			default:
+				log.Printf("Error consuming single-use link %s: %v", shortCode, err)
+				http.Error(w, "Error checking link status", http.StatusInternalServerError)
+			}
+			return
+		}
+	}
 
-	http.Redirect(w, r, urlRecord.LongURL, http.StatusMovedPermanently)
+	destination, targetRule := us.selectTarget(r, urlRecord)
+	var variant string
+	if targetRule == "" && len(urlRecord.Variants) > 0 {
+		v := us.selectVariant(w, r, urlRecord)
+		destination, variant = v.URL, v.Name
+	}
+	destination = us.buildDestination(r, urlRecord, destination, targetRule, variant)
+
+	isBot := us.bots.IsBot(r.UserAgent())
+	us.countClick(ctx, LinkKey{domain, shortCode}, isBot)
+	us.RecordAnalytics(r, AnalyticsEvent{
+		Domain:     domain,
+		ShortCode:  shortCode,
+		IPAddress:  clientAddress(r),
+		IsBot:      isBot,
+		TargetRule: targetRule,
+		Variant:    variant,
+	})
+
+	us.sendRedirect(w, r, urlRecord, destination)
 }
 
 func (us *URLShortener) statsHandler(w http.ResponseWriter, r *http.Request) {
@@ -443,7 +834,16 @@ func (us *URLShortener) statsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	urlRecord, err := us.GetURL(ctx, shortCode)
+	domain, err := us.requestDomain(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	urlRecord, err := us.GetURL(ctx, domain, shortCode)
+	if err == nil && urlRecord.OwnerID != ownerFromContext(ctx) {
+		err = ErrNotFound
+	}
 	if err != nil {
 		if ctx.Err() == context.DeadlineExceeded {
 			http.Error(w, "Request timeout", http.StatusRequestTimeout)
@@ -453,7 +853,7 @@ func (us *URLShortener) statsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = us.db.QueryRowContext(ctx, "SELECT clicks FROM urls WHERE short_code = $1", shortCode).Scan(&urlRecord.Clicks)
+	clicks, err := us.clickCount(ctx, domain, shortCode)
 	if err != nil {
 		if ctx.Err() == context.DeadlineExceeded {
 			http.Error(w, "Request timeout", http.StatusRequestTimeout)
@@ -463,7 +863,17 @@ func (us *URLShortener) statsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	analytics, err := us.GetAnalytics(ctx, shortCode)
+	analytics, err := us.GetAnalytics(ctx, domain, shortCode)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			http.Error(w, "Request timeout", http.StatusRequestTimeout)
+			return
+		}
+		http.Error(w, "Error retrieving analytics", http.StatusInternalServerError)
+		return
+	}
+
+	breakdowns, err := us.store.GetBreakdowns(ctx, domain, shortCode, breakdownLimit)
 	if err != nil {
 		if ctx.Err() == context.DeadlineExceeded {
 			http.Error(w, "Request timeout", http.StatusRequestTimeout)
@@ -473,14 +883,25 @@ func (us *URLShortener) statsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	stats := map[string]interface{}{
+		"short_url":    us.shortURL(urlRecord),
+		"short_code":   urlRecord.ShortCode,
+		"long_url":     urlRecord.LongURL,
+		"clicks":       clicks.Total,
+		"human_clicks": clicks.Human(),
+		"bot_clicks":   clicks.Bots,
+		"created_at":   urlRecord.CreatedAt,
+		"analytics":    analytics,
+		"breakdowns":   breakdowns,
+
+		"unique_visitors_estimate": us.uniques.Total(ctx, LinkKey{domain, shortCode}),
+	}
+	if len(urlRecord.Variants) > 0 {
+		stats["variants"] = variantStats(urlRecord, breakdowns["variants"])
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"short_code": urlRecord.ShortCode,
-		"long_url":   urlRecord.LongURL,
-		"clicks":     urlRecord.Clicks,
-		"created_at": urlRecord.CreatedAt,
-		"analytics":  analytics,
-	})
+	json.NewEncoder(w).Encode(stats)
 }
 
 func (us *URLShortener) listHandler(w http.ResponseWriter, r *http.Request) {
@@ -491,23 +912,14 @@ func (us *URLShortener) listHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	rows, err := us.db.Query("SELECT id, short_code, long_url, clicks, created_at FROM urls ORDER BY created_at DESC LIMIT $1", limit)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	urls, err := us.store.ListURLs(ctx, ownerFromContext(ctx), limit)
 	if err != nil {
 		http.Error(w, "Error retrieving URLs", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	var urls []URL
-	for rows.Next() {
-		var url URL
-		err := rows.Scan(&url.ID, &url.ShortCode, &url.LongURL, &url.Clicks, &url.CreatedAt)
-		if err != nil {
-			http.Error(w, "Error scanning URL", http.StatusInternalServerError)
-			return
-		}
-		urls = append(urls, url)
-	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -537,9 +949,30 @@ func homeHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(html))
 }
 
+// Close stops the background workers, waits for queued analytics events to
+// be written (up to AnalyticsFlushTimeout) and closes the connections.
 func (us *URLShortener) Close() error {
+	close(us.quit)
+
+	us.closeMu.Lock()
+	us.closed = true
 	close(us.analyticsChannel)
+	us.closeMu.Unlock()
+
+	timer := time.AfterFunc(us.cfg.AnalyticsFlushTimeout, func() {
+		log.Printf("Analytics flush did not finish within %s, abandoning remaining events", us.cfg.AnalyticsFlushTimeout)
+		us.cancelFlush()
+	})
 	us.wg.Wait()
+	timer.Stop()
+	us.cancelFlush()
+
+	if err := us.spill.Close(); err != nil {
+		log.Printf("Error closing analytics spill log: %v", err)
+	}
+	if err := us.geo.Close(); err != nil {
+		log.Printf("Error closing GeoIP database: %v", err)
+	}
 
 	if us.redisClient != nil {
 		if err := us.redisClient.Close(); err != nil {
@@ -547,49 +980,92 @@ func (us *URLShortener) Close() error {
 		}
 	}
 
-	return us.db.Close()
+	return us.store.Close()
 }
 
 func main() {
-	dbURL := os.Getenv("DATABASE_URL")
-	if dbURL == "" {
-		log.Fatal("DATABASE_URL environment variable is required")
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	redisAddr := os.Getenv("REDIS_ADDR") // Get Redis address
-	if redisAddr == "" {
-		log.Fatal("REDIS_ADDR environment variable is required")
+	store, err := NewStore(cfg)
+	if err != nil {
+		log.Fatal("Failed to initialize storage:", err)
+	}
+
+	if len(os.Args) > 1 {
+		if err := runCommand(store, os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	shortener, err := NewURLShortener(dbURL, redisAddr)
+	shortener, err := NewURLShortener(cfg, store)
 	if err != nil {
 		log.Fatal("Failed to initialize URL shortener:", err)
 	}
-	defer shortener.Close()
 
 	r := mux.NewRouter()
 
 	r.HandleFunc("/health", healthHandler).Methods("GET")
+	r.HandleFunc("/metrics", shortener.metricsHandler).Methods("GET")
 	r.HandleFunc("/", homeHandler).Methods("GET")
-	r.HandleFunc("/api/shorten", shortener.shortenHandler).Methods("POST")
-	r.HandleFunc("/api/stats/{shortCode}", shortener.statsHandler).Methods("GET")
-	r.HandleFunc("/api/list", shortener.listHandler).Methods("GET")
-	r.HandleFunc("/{shortCode}", shortener.redirectHandler).Methods("GET")
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
+	api := r.PathPrefix("/api").Subrouter()
+	api.Use(shortener.authMiddleware)
+	api.HandleFunc("/shorten", shortener.shortenHandler).Methods("POST")
+	api.HandleFunc("/stats/{shortCode}", shortener.statsHandler).Methods("GET")
+	api.HandleFunc("/stats/{shortCode}/timeseries", shortener.timeseriesHandler).Methods("GET")
+	api.HandleFunc("/list", shortener.listHandler).Methods("GET")
+	api.HandleFunc("/links/{shortCode}", shortener.updateLinkHandler).Methods("PATCH")
+	api.HandleFunc("/links/{shortCode}", shortener.deleteLinkHandler).Methods("DELETE")
+	api.HandleFunc("/links/{shortCode}/disable", shortener.disableLinkHandler).Methods("POST")
+
+	admin := api.PathPrefix("/admin").Subrouter()
+	admin.Use(adminMiddleware)
+	admin.HandleFunc("/analytics", shortener.deleteAnalyticsByIPHandler).Methods("DELETE")
+
+	r.HandleFunc("/preview/{shortCode}", shortener.previewHandler).Methods("GET")
+	r.HandleFunc("/{shortCode}+", shortener.previewHandler).Methods("GET")
+	r.HandleFunc("/{shortCode}", shortener.redirectHandler).Methods("GET")
+	r.HandleFunc("/{shortCode}", shortener.passwordHandler).Methods("POST")
 
 	server := &http.Server{
-		Addr:         ":" + port,
+		Addr:         ":" + cfg.Port,
 		Handler:      r,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
 
-	fmt.Println("URL Shortener started on http://localhost:8080")
-	fmt.Println("Visit http://localhost:8080 for the web interface")
-	log.Fatal(server.ListenAndServe())
+	fmt.Printf("URL Shortener listening on :%s\n", cfg.Port)
+	fmt.Printf("Visit %s for the web interface\n", cfg.BaseURL)
+	for host := range cfg.BrandedDomains {
+		fmt.Printf("Serving branded domain %s\n", host)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	log.Println("Shutting down...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down HTTP server: %v", err)
+	}
+
+	if err := shortener.Close(); err != nil {
+		log.Printf("Error closing URL shortener: %v", err)
+	}
+	log.Println("Shutdown complete")
 }
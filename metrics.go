@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// metricsHandler exposes operational metrics in the Prometheus text format.
+func (us *URLShortener) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	spill := us.spill.Stats()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(w, "analytics_queue_length", "gauge", "Analytics events waiting in the in-memory queue.", len(us.analyticsChannel))
+	writeMetric(w, "analytics_spill_segments", "gauge", "Segment files in the analytics spill log.", spill.Segments)
+	writeMetric(w, "analytics_spill_bytes", "gauge", "Size of the analytics spill log on disk.", spill.Bytes)
+	writeMetric(w, "analytics_spilled_events_total", "counter", "Analytics events written to the spill log.", spill.SpilledEvents)
+	writeMetric(w, "analytics_replayed_events_total", "counter", "Spilled analytics events replayed into the store.", spill.ReplayedEvents)
+	writeMetric(w, "analytics_spill_replay_lag_seconds", "gauge", "Age of the oldest spilled event not yet replayed.", spill.ReplayLag.Seconds())
+}
+
+func writeMetric(w http.ResponseWriter, name, kind, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+	"net/http"
+	"path/filepath"
+)
+
+// renderPage renders templates/<name> with data. Like home.html, templates
+// are read on every request so they can be edited without a restart. Pages
+// depend on the link and visitor, so they are never cached.
+func renderPage(w http.ResponseWriter, status int, name string, data interface{}) {
+	tmpl, err := template.ParseFiles(filepath.Join("templates", name))
+	if err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		log.Println("Error reading template:", err)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		log.Printf("Error rendering %s: %v", name, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
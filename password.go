@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password-protected links answer GET /{shortCode} with a password form
+// instead of a redirect. The form posts back to the same URL; a correct
+// password earns a signed cookie, scoped to the link's path, that lets the
+// visitor through for LinkAccessTTL. Attempts are limited per client IP.
+
+const (
+	linkAccessCookie      = "link_access"
+	passwordAttemptPrefix = "pwattempts:"
+	// bcrypt ignores everything past 72 bytes.
+	maxLinkPasswordLength = 72
+)
+
+func hashLinkPassword(password string) (string, error) {
+	if password == "" {
+		return "", fmt.Errorf("password must not be empty")
+	}
+	if len(password) > maxLinkPasswordLength {
+		return "", fmt.Errorf("password must be at most %d bytes", maxLinkPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// setPasswordHash protects u with a password hash, or removes the
+// protection when hash is empty.
+func (u *URL) setPasswordHash(hash string) {
+	u.PasswordHash, u.PasswordProtected, u.PasswordVersion = hash, hash != "", ""
+	if hash != "" {
+		sum := sha256.Sum256([]byte(hash))
+		u.PasswordVersion = base64.RawURLEncoding.EncodeToString(sum[:12])
+	}
+}
+
+// samePassword reports whether u is protected by password, or unprotected
+// when password is empty.
+func samePassword(u *URL, password string) bool {
+	if password == "" {
+		return !u.PasswordProtected
+	}
+	return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+}
+
+// linkCookieSecret returns the key that signs access cookies. Without
+// LINK_COOKIE_SECRET a random key is used, so cookies only work on the
+// instance that issued them and until it restarts.
+func linkCookieSecret(cfg *Config) ([]byte, error) {
+	if cfg.LinkCookieSecret != "" {
+		return []byte(cfg.LinkCookieSecret), nil
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("generating cookie secret: %w", err)
+	}
+	log.Printf("LINK_COOKIE_SECRET is not set, password-protected link cookies will not survive a restart")
+	return secret, nil
+}
+
+func (us *URLShortener) linkAccessMAC(u *URL, expires int64) string {
+	mac := hmac.New(sha256.New, us.cookieSecret)
+	fmt.Fprintf(mac, "%s|%s|%d", cacheKey(u.Domain, u.ShortCode), u.PasswordVersion, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// grantLinkAccess sets a cookie of the form "<expiry>.<mac>" admitting the
+// visitor to u until the expiry.
+func (us *URLShortener) grantLinkAccess(w http.ResponseWriter, u *URL) {
+	expires := time.Now().Add(us.cfg.LinkAccessTTL)
+	http.SetCookie(w, &http.Cookie{
+		Name:     linkAccessCookie,
+		Value:    strconv.FormatInt(expires.Unix(), 10) + "." + us.linkAccessMAC(u, expires.Unix()),
+		Path:     "/" + u.ShortCode,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(us.shortURL(u), "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (us *URLShortener) hasLinkAccess(r *http.Request, u *URL) bool {
+	cookie, err := r.Cookie(linkAccessCookie)
+	if err != nil {
+		return false
+	}
+	rawExpires, mac, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return false
+	}
+	expires, err := strconv.ParseInt(rawExpires, 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return false
+	}
+	return hmac.Equal([]byte(mac), []byte(us.linkAccessMAC(u, expires)))
+}
+
+// allowPasswordAttempt counts an attempt on u from a client address in the
+// current window and reports whether it is within both
+// PASSWORD_ATTEMPT_LIMIT for the address and PASSWORD_LINK_ATTEMPT_LIMIT for
+// the link. The link budget caps guessing spread over many addresses; only
+// attempts within an address's own limit count against it, so a single
+// client cannot use it up.
+func (us *URLShortener) allowPasswordAttempt(ctx context.Context, u *URL, address string) (bool, error) {
+	ip := address
+	if parsed := parseClientIP(address); parsed != nil {
+		ip = parsed.String()
+	}
+	window := us.cfg.PasswordAttemptWindow
+	suffix := ":" + strconv.FormatInt(time.Now().UnixNano()/int64(window), 10)
+	ipKey := passwordAttemptPrefix + "ip:" + ip + suffix
+	linkKey := passwordAttemptPrefix + "link:" + cacheKey(u.Domain, u.ShortCode) + suffix
+
+	allowed, err := us.countAttempt(ctx, ipKey, window, us.cfg.PasswordAttemptLimit)
+	if err != nil || !allowed {
+		return false, err
+	}
+	return us.countAttempt(ctx, linkKey, window, us.cfg.PasswordLinkAttemptLimit)
+}
+
+// countAttempt increments a window counter and reports whether it is
+// within limit.
+func (us *URLShortener) countAttempt(ctx context.Context, key string, window time.Duration, limit int) (bool, error) {
+	var attempts *redis.IntCmd
+	_, err := us.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		attempts = pipe.Incr(ctx, key)
+		pipe.Expire(ctx, key, window)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return attempts.Val() <= int64(limit), nil
+}
+
+func (us *URLShortener) renderPasswordForm(w http.ResponseWriter, r *http.Request, u *URL, status int, message string) {
+	renderPage(w, status, "password.html", struct {
+		ShortURL string
+		Action   string
+		Error    string
+	}{us.shortURL(u), r.URL.RequestURI(), message})
+}
+
+// passwordHandler checks a password posted from the form and, if it is
+// correct, sends the visitor back to the link with an access cookie.
+func (us *URLShortener) passwordHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	shortCode := mux.Vars(r)["shortCode"]
+	domain := us.domainForHost(r.Host)
+
+	urlRecord, err := us.store.GetURL(ctx, domain, shortCode)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			http.Error(w, "Request timeout", http.StatusRequestTimeout)
+			return
+		}
+		http.Error(w, "Short URL not found", http.StatusNotFound)
+		return
+	}
+	if !urlRecord.PasswordProtected {
+		http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+		return
+	}
+
+	allowed, err := us.allowPasswordAttempt(ctx, urlRecord, us.peerAddress(r))
+	if err != nil {
+		log.Printf("Error counting password attempts: %v", err)
+		http.Error(w, "Password check unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if !allowed {
+		us.renderPasswordForm(w, r, urlRecord, http.StatusTooManyRequests, "Too many attempts. Please try again later.")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	password := r.PostFormValue("password")
+	if bcrypt.CompareHashAndPassword([]byte(urlRecord.PasswordHash), []byte(password)) != nil {
+		us.renderPasswordForm(w, r, urlRecord, http.StatusUnauthorized, "Incorrect password.")
+		return
+	}
+
+	us.grantLinkAccess(w, urlRecord)
+	http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// GET /{shortCode}+ and GET /preview/{shortCode} show where a link leads
+// instead of following it. Previews are neither counted as clicks nor
+// recorded in analytics. The destination is not shown for links that are
+// password-protected, single-use, not active yet, disabled or flagged, so a
+// preview never reveals what the link itself would not.
+
+const maxTitleLength = 200
+
+func validateTitle(title string) error {
+	if utf8.RuneCountInString(title) > maxTitleLength {
+		return fmt.Errorf("title must be at most %d characters", maxTitleLength)
+	}
+	return nil
+}
+
+func (us *URLShortener) previewHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	shortCode := mux.Vars(r)["shortCode"]
+	domain := us.domainForHost(r.Host)
+
+	urlRecord, err := us.GetURL(ctx, domain, shortCode)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			http.Error(w, "Request timeout", http.StatusRequestTimeout)
+			return
+		}
+		http.Error(w, "Short URL not found", http.StatusNotFound)
+		return
+	}
+
+	clicks, err := us.clickCount(ctx, domain, shortCode)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			http.Error(w, "Request timeout", http.StatusRequestTimeout)
+			return
+		}
+		http.Error(w, "Error retrieving stats", http.StatusInternalServerError)
+		return
+	}
+
+	expired, err := us.isExpired(ctx, urlRecord)
+	if err != nil {
+		http.Error(w, "Error checking link status", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	var status string
+	switch {
+	case urlRecord.DisabledAt != nil:
+		status = "This link has been disabled."
+	case urlRecord.FlaggedAt != nil:
+		status = "This link leads to a site reported for phishing or malware."
+	case expired:
+		status = "This link has expired."
+	case urlRecord.ConsumedAt != nil:
+		status = "This link has already been used."
+	case !isActiveAt(urlRecord, now):
+		status = "This link is not active right now."
+	}
+
+	var hidden string
+	switch {
+	case urlRecord.PasswordProtected:
+		hidden = "this link is password-protected"
+	case urlRecord.SingleUse:
+		hidden = "this link can only be opened once"
+	case urlRecord.DisabledAt != nil:
+		hidden = "this link has been disabled"
+	case urlRecord.FlaggedAt != nil:
+		hidden = "this link is reported as unsafe"
+	case urlRecord.ActiveFrom != nil && now.Before(*urlRecord.ActiveFrom):
+		hidden = "this link is not active yet"
+	}
+	destination := urlRecord.LongURL
+	if hidden != "" {
+		destination = ""
+	}
+
+	renderPage(w, http.StatusOK, "preview.html", struct {
+		ShortURL    string
+		Destination string
+		Title       string
+		CreatedAt   time.Time
+		Clicks      int
+		Hidden      string
+		Varies      bool
+		Status      string
+	}{
+		ShortURL:    us.shortURL(urlRecord),
+		Destination: destination,
+		Title:       urlRecord.Title,
+		CreatedAt:   urlRecord.CreatedAt,
+		Clicks:      clicks.Total,
+		Hidden:      hidden,
+		Varies:      len(urlRecord.Targets) > 0 || len(urlRecord.Variants) > 0,
+		Status:      status,
+	})
+}
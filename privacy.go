@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Client IPs are anonymized before analytics events are stored or spilled,
+// according to IP_ANONYMIZATION:
+//
+//	none      the IP is stored as is
+//	truncate  the last octet of IPv4 addresses and the last 80 bits of IPv6
+//	          addresses are zeroed (/24 and /48 networks)
+//	hash      the IP is replaced by an HMAC-SHA256 keyed with IP_HASH_KEY
+//
+// Geolocation runs first, so it still sees the full address.
+
+const (
+	ipAnonymizeNone     = "none"
+	ipAnonymizeTruncate = "truncate"
+	ipAnonymizeHash     = "hash"
+)
+
+var (
+	ipv4TruncateMask = net.CIDRMask(24, 32)
+	ipv6TruncateMask = net.CIDRMask(48, 128)
+)
+
+// anonymizeIP applies the configured anonymization to a client address.
+// Ports are dropped in every mode.
+func (us *URLShortener) anonymizeIP(address string) string {
+	ip := parseClientIP(address)
+	if ip == nil {
+		return address
+	}
+
+	switch us.cfg.IPAnonymization {
+	case ipAnonymizeTruncate:
+		if v4 := ip.To4(); v4 != nil {
+			return v4.Mask(ipv4TruncateMask).String()
+		}
+		return ip.Mask(ipv6TruncateMask).String()
+	case ipAnonymizeHash:
+		mac := hmac.New(sha256.New, []byte(us.cfg.IPHashKey))
+		mac.Write([]byte(ip.String()))
+		return hex.EncodeToString(mac.Sum(nil))
+	default:
+		return ip.String()
+	}
+}
+
+// prepareEvents geolocates events, computes their visitor fingerprint and
+// anonymizes their IPs. It runs before events are stored or spilled, and
+// skips events already prepared.
+func (us *URLShortener) prepareEvents(events []AnalyticsEvent) {
+	for i := range events {
+		if events[i].Prepared {
+			continue
+		}
+		us.enrichEvent(&events[i])
+		events[i].VisitorHash = us.visitorFingerprint(events[i].IPAddress, events[i].UserAgent)
+		events[i].IPAddress = us.anonymizeIP(events[i].IPAddress)
+		events[i].Prepared = true
+	}
+}
+
+// storedIPForms returns the values under which analytics rows for address
+// may have been stored: the anonymized form, and the plain IP for rows
+// written before anonymization was enabled.
+func (us *URLShortener) storedIPForms(address string) []string {
+	ip := parseClientIP(address)
+	if ip == nil {
+		return nil
+	}
+	forms := []string{ip.String()}
+	if anonymized := us.anonymizeIP(address); anonymized != ip.String() {
+		forms = append(forms, anonymized)
+	}
+	return forms
+}
+
+// retentionPruner periodically deletes analytics rows older than the
+// retention window. Hourly and daily rollups are aggregates and are kept.
+func (us *URLShortener) retentionPruner(retention, interval time.Duration) {
+	defer us.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-us.quit:
+			return
+		case <-ticker.C:
+			us.pruneAnalytics(retention)
+		}
+	}
+}
+
+func (us *URLShortener) pruneAnalytics(retention time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	deleted, err := us.store.PruneAnalytics(ctx, time.Now().UTC().Add(-retention))
+	if err != nil {
+		log.Printf("Error pruning analytics: %v", err)
+		return
+	}
+	if deleted > 0 {
+		log.Printf("Pruned %d analytics rows older than %s", deleted, retention)
+	}
+}
+
+// deleteAnalyticsByIPHandler serves data-subject deletion requests:
+// DELETE /api/admin/analytics?ip=<address> removes every analytics row
+// recorded for the address, across all links and owners. With truncation
+// enabled this covers the whole /24 or /48 network.
+func (us *URLShortener) deleteAnalyticsByIPHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	ip := r.URL.Query().Get("ip")
+	forms := us.storedIPForms(ip)
+	if len(forms) == 0 {
+		http.Error(w, "ip must be an IPv4 or IPv6 address", http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := us.store.DeleteAnalyticsByIP(ctx, forms)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			http.Error(w, "Request timeout", http.StatusRequestTimeout)
+			return
+		}
+		log.Printf("Error deleting analytics for IP: %v", err)
+		http.Error(w, "Error deleting analytics", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Deleted %d analytics rows on data-subject request", deleted)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"deleted": deleted,
+	})
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Redirects can carry query parameters the stored URL does not have. With
+// query_forwarding set, the query string of the short URL is forwarded onto
+// the destination:
+//
+//	merge     parameters the destination already has are kept, the others
+//	          are added
+//	override  forwarded parameters replace those of the same name
+//	append    both are kept, the destination's first
+//
+// UTM templates then fill in utm_source, utm_medium and utm_campaign, unless
+// the destination or the forwarded query already set them. Templates may use
+// the placeholders listed in utmPlaceholders.
+
+var queryForwardingModes = map[string]bool{
+	"":         true,
+	"merge":    true,
+	"override": true,
+	"append":   true,
+}
+
+func validateQueryForwarding(mode string) error {
+	if !queryForwardingModes[mode] {
+		return fmt.Errorf("query_forwarding must be merge, override or append")
+	}
+	return nil
+}
+
+// utmPlaceholders are the values a UTM template can refer to as {name}:
+// the short code, the host of the short URL, and the targeting rule and
+// variant chosen for the visit.
+var utmPlaceholders = map[string]bool{
+	"short_code":  true,
+	"domain":      true,
+	"target_rule": true,
+	"variant":     true,
+}
+
+// validateUTMTemplate checks that template only uses known placeholders.
+func validateUTMTemplate(field, template string) error {
+	rest := template
+	for {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			return nil
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return fmt.Errorf("%s has an unclosed placeholder", field)
+		}
+		if name := rest[start+1 : start+end]; !utmPlaceholders[name] {
+			return fmt.Errorf("%s: unknown placeholder {%s}", field, name)
+		}
+		rest = rest[start+end+1:]
+	}
+}
+
+// validateUTMTemplates checks the UTM templates of u.
+func validateUTMTemplates(u *URL) error {
+	for _, p := range u.utmParameters() {
+		if err := validateUTMTemplate(p.name, p.template); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type utmParameter struct {
+	name     string
+	template string
+}
+
+func (u *URL) utmParameters() []utmParameter {
+	return []utmParameter{
+		{"utm_source", u.UTMSource},
+		{"utm_medium", u.UTMMedium},
+		{"utm_campaign", u.UTMCampaign},
+	}
+}
+
+func (u *URL) hasUTM() bool {
+	return u.UTMSource != "" || u.UTMMedium != "" || u.UTMCampaign != ""
+}
+
+// buildDestination forwards the query of r onto destination and applies the
+// UTM templates of u. targetRule and variant are those chosen for this
+// visit. The destination is returned untouched when there is nothing to add.
+func (us *URLShortener) buildDestination(r *http.Request, u *URL, destination, targetRule, variant string) string {
+	incoming := r.URL.Query()
+	if (u.QueryForwarding == "" || len(incoming) == 0) && !u.hasUTM() {
+		return destination
+	}
+	target, err := url.Parse(destination)
+	if err != nil {
+		return destination
+	}
+
+	// Parameters are appended to the destination's raw query so it reaches
+	// the destination exactly as stored, unless some of it is overridden.
+	query := target.Query()
+	added := url.Values{}
+	rewrite := false
+	switch u.QueryForwarding {
+	case "merge":
+		for name, values := range incoming {
+			if _, ok := query[name]; !ok {
+				added[name] = values
+			}
+		}
+	case "override":
+		for name, values := range incoming {
+			if _, ok := query[name]; ok {
+				rewrite = true
+				query[name] = values
+			} else {
+				added[name] = values
+			}
+		}
+	case "append":
+		for name, values := range incoming {
+			added[name] = values
+		}
+	}
+
+	var domain string
+	if base, err := url.Parse(us.baseURLFor(u.Domain)); err == nil {
+		domain = base.Host
+	}
+	placeholders := strings.NewReplacer(
+		"{short_code}", u.ShortCode,
+		"{domain}", domain,
+		"{target_rule}", targetRule,
+		"{variant}", variant,
+	)
+	for _, p := range u.utmParameters() {
+		if p.template != "" && query.Get(p.name) == "" && added.Get(p.name) == "" {
+			added.Set(p.name, placeholders.Replace(p.template))
+		}
+	}
+
+	if rewrite {
+		for name, values := range added {
+			query[name] = append(query[name], values...)
+		}
+		target.RawQuery = query.Encode()
+	} else if len(added) > 0 {
+		if target.RawQuery != "" {
+			target.RawQuery += "&"
+		}
+		target.RawQuery += added.Encode()
+	}
+	return target.String()
+}
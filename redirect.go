@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Each link may choose the status code of its redirect; links without one
+// use DEFAULT_REDIRECT_TYPE. Permanent redirects (301, 308) are cached by
+// browsers, so repeat visits skip the shortener entirely: they get a bounded
+// max-age, and never one outliving the link. Temporary redirects (302, 307)
+// are marked no-store so every visit reaches us and is counted. Neither
+// outlives the link's expiry or the end of its activation window.
+
+var redirectTypes = map[int]bool{
+	http.StatusMovedPermanently:  true,
+	http.StatusFound:             true,
+	http.StatusTemporaryRedirect: true,
+	http.StatusPermanentRedirect: true,
+}
+
+func validateRedirectType(code int) error {
+	if !redirectTypes[code] {
+		return fmt.Errorf("redirect_type must be 301, 302, 307 or 308")
+	}
+	return nil
+}
+
+func isPermanentRedirect(code int) bool {
+	return code == http.StatusMovedPermanently || code == http.StatusPermanentRedirect
+}
+
+// redirectStatus returns the status code used to redirect u. A RedirectType
+// of 0 means the link uses the global default.
+func (us *URLShortener) redirectStatus(u *URL) int {
+	if u.RedirectType != 0 {
+		return u.RedirectType
+	}
+	return us.cfg.DefaultRedirectType
+}
+
+// redirectCacheControl returns the Cache-Control header for a redirect of u.
+// Links with a click budget, a password or a single use must see every
+// visit, so they are never cached.
+func (us *URLShortener) redirectCacheControl(u *URL, status int) string {
+	if !isPermanentRedirect(status) || u.MaxClicks != nil || u.PasswordProtected || u.SingleUse {
+		return "no-store"
+	}
+
+	// Targeted and split links redirect each visitor differently, so only
+	// the visitor's own browser may cache them.
+	scope := "public"
+	if len(u.Targets) > 0 || len(u.Variants) > 0 {
+		scope = "private"
+	}
+
+	maxAge := us.cfg.PermanentRedirectMaxAge
+	if u.ExpiresAt != nil {
+		if remaining := time.Until(*u.ExpiresAt); remaining < maxAge {
+			maxAge = remaining
+		}
+	}
+	if remaining, ok := nextWindowBoundary(u, time.Now()); ok && remaining < maxAge {
+		maxAge = remaining
+	}
+	if maxAge < time.Second {
+		return "no-store"
+	}
+	return scope + ", max-age=" + strconv.Itoa(int(maxAge/time.Second))
+}
+
+// sendRedirect redirects the client to destination with the status code
+// and caching policy of u.
+func (us *URLShortener) sendRedirect(w http.ResponseWriter, r *http.Request, u *URL, destination string) {
+	status := us.redirectStatus(u)
+	w.Header().Set("Cache-Control", us.redirectCacheControl(u, status))
+	http.Redirect(w, r, destination, status)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Links may be limited to an activation window [active_from, active_until).
+// Outside it they redirect to their fallback_url, or answer 404 before the
+// window opens and 410 after it closes. Fallback redirects are temporary and
+// are not counted as clicks.
+
+// validateActiveWindow checks the window and fallback of u.
+func validateActiveWindow(u *URL) error {
+	if u.ActiveFrom != nil && u.ActiveUntil != nil && !u.ActiveFrom.Before(*u.ActiveUntil) {
+		return fmt.Errorf("active_from must be before active_until")
+	}
+	if u.FallbackURL != "" && !isValidURL(u.FallbackURL) {
+		return fmt.Errorf("invalid fallback_url format")
+	}
+	return nil
+}
+
+// isActiveAt reports whether now falls inside the activation window of u.
+func isActiveAt(u *URL, now time.Time) bool {
+	if u.ActiveFrom != nil && now.Before(*u.ActiveFrom) {
+		return false
+	}
+	if u.ActiveUntil != nil && !now.Before(*u.ActiveUntil) {
+		return false
+	}
+	return true
+}
+
+// nextWindowBoundary returns how long until the activation window of u next
+// opens or closes, or false if it never will.
+func nextWindowBoundary(u *URL, now time.Time) (time.Duration, bool) {
+	for _, boundary := range []*time.Time{u.ActiveFrom, u.ActiveUntil} {
+		if boundary != nil && boundary.After(now) {
+			return boundary.Sub(now), true
+		}
+	}
+	return 0, false
+}
+
+// serveInactiveLink answers a request for a link outside its window.
+func (us *URLShortener) serveInactiveLink(w http.ResponseWriter, r *http.Request, u *URL, now time.Time) {
+	w.Header().Set("Cache-Control", "no-store")
+	switch {
+	case u.FallbackURL != "":
+		http.Redirect(w, r, u.FallbackURL, http.StatusFound)
+	case u.ActiveFrom != nil && now.Before(*u.ActiveFrom):
+		http.Error(w, "Short URL is not active yet", http.StatusNotFound)
+	default:
+		http.Error(w, "Short URL is no longer active", http.StatusGone)
+	}
+}
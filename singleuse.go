@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Single-use links redirect exactly once. The store decides which request
+// wins: ConsumeURL marks the link consumed only if it was not already, in a
+// single conditional UPDATE, so concurrent requests on any number of
+// instances cannot both succeed. A Redis marker set with SETNX in front of
+// it turns most losers away without a database write.
+//
+// Bots, such as the unfurlers of chat apps that fetch a link as soon as it
+// is posted, get a notice page instead, so they cannot use up the redirect
+// meant for the recipient.
+
+const consumedKeyPrefix = "consumed:"
+
+// consumedMarkerTTL only needs to outlive the cached copies of the link.
+const consumedMarkerTTL = 24 * time.Hour
+
+// consumeLink claims the single redirect of u, returning ErrLinkConsumed if
+// another request already has.
+func (us *URLShortener) consumeLink(ctx context.Context, u *URL) error {
+	key := consumedKeyPrefix + cacheKey(u.Domain, u.ShortCode)
+
+	claimed, err := us.redisClient.SetNX(ctx, key, time.Now().UTC().Format(time.RFC3339), consumedMarkerTTL).Result()
+	if err != nil {
+		// Without Redis the store alone still decides.
+		log.Printf("Error claiming single-use link %s in Redis: %v", u.ShortCode, err)
+	} else if !claimed {
+		return ErrLinkConsumed
+	}
+
+	if err := us.store.ConsumeURL(ctx, u.Domain, u.ShortCode, time.Now().UTC()); err != nil {
+		if err != ErrLinkConsumed && claimed {
+			// The link may still be unused; let the next request try.
+			us.redisClient.Del(context.Background(), key)
+		}
+		return err
+	}
+
+	us.invalidateURL(ctx, u.Domain, u.ShortCode)
+	return nil
+}
+
+// serveSingleUseNotice answers a bot with a page that neither redirects nor
+// shows the destination, and leaves the link unused.
+func (us *URLShortener) serveSingleUseNotice(w http.ResponseWriter, u *URL) {
+	renderPage(w, http.StatusOK, "singleuse.html", struct {
+		ShortURL string
+	}{us.shortURL(u)})
+}
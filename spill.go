@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spillSegmentBytes = 4 << 20
+	spillReplayBatch  = 500
+	spillSegmentExt   = ".log"
+)
+
+// spillLog is an append-only log of analytics events that could not be
+// written to the store, either because the analytics channel was full or
+// because a batch failed to commit. Events are stored one JSON object per
+// line in numbered segment files; the open segment is sealed when it grows
+// past spillSegmentBytes or when a replay starts, and sealed segments are
+// replayed oldest first and deleted once written.
+//
+// Appends are not fsynced individually, so events survive a process crash
+// but not a power loss.
+type spillLog struct {
+	dir string
+
+	mu      sync.Mutex
+	current *os.File
+	curSeq  uint64
+	curSize int64
+	nextSeq uint64
+
+	// segments maps each segment on disk to its size and the timestamp of
+	// its oldest event, for metrics.
+	segments map[uint64]spillSegment
+
+	spilled  uint64
+	replayed uint64
+}
+
+type spillSegment struct {
+	size   int64
+	oldest time.Time
+}
+
+// SpillStats is a snapshot of the spill log for metrics.
+type SpillStats struct {
+	Segments       int
+	Bytes          int64
+	SpilledEvents  uint64
+	ReplayedEvents uint64
+	// ReplayLag is the age of the oldest event still waiting to be replayed.
+	ReplayLag time.Duration
+}
+
+func openSpillLog(dir string) (*spillLog, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating spill directory: %w", err)
+	}
+
+	s := &spillLog{dir: dir, nextSeq: 1, segments: make(map[uint64]spillSegment)}
+	seqs, err := s.segmentSeqs()
+	if err != nil {
+		return nil, err
+	}
+	for _, seq := range seqs {
+		info, err := os.Stat(s.segmentPath(seq))
+		if err != nil {
+			return nil, err
+		}
+		s.segments[seq] = spillSegment{size: info.Size(), oldest: s.firstEventTime(seq)}
+		s.nextSeq = seq + 1
+	}
+	if len(seqs) > 0 {
+		log.Printf("Found %d analytics spill segments to replay in %s", len(seqs), dir)
+	}
+	return s, nil
+}
+
+func (s *spillLog) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spillSegmentExt))
+}
+
+// segmentSeqs lists the segment files on disk in order.
+func (s *spillLog) segmentSeqs() ([]uint64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading spill directory: %w", err)
+	}
+
+	var seqs []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, spillSegmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spillSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+func (s *spillLog) firstEventTime(seq uint64) time.Time {
+	f, err := os.Open(s.segmentPath(seq))
+	if err != nil {
+		return time.Time{}
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	var event AnalyticsEvent
+	if scanner.Scan() && json.Unmarshal(scanner.Bytes(), &event) == nil {
+		return event.Timestamp
+	}
+	return time.Time{}
+}
+
+// Append writes events to the open segment, starting a new one if needed.
+func (s *spillLog) Append(events ...AnalyticsEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	var buf []byte
+	for _, event := range events {
+		line, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current == nil {
+		f, err := os.OpenFile(s.segmentPath(s.nextSeq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("opening spill segment: %w", err)
+		}
+		s.current, s.curSeq, s.curSize = f, s.nextSeq, 0
+		s.nextSeq++
+		s.segments[s.curSeq] = spillSegment{oldest: events[0].Timestamp}
+	}
+
+	n, err := s.current.Write(buf)
+	s.curSize += int64(n)
+	seg := s.segments[s.curSeq]
+	seg.size = s.curSize
+	s.segments[s.curSeq] = seg
+	if err != nil {
+		return fmt.Errorf("writing spill segment: %w", err)
+	}
+	s.spilled += uint64(len(events))
+
+	if s.curSize >= spillSegmentBytes {
+		return s.sealLocked()
+	}
+	return nil
+}
+
+func (s *spillLog) sealLocked() error {
+	if s.current == nil {
+		return nil
+	}
+	f := s.current
+	s.current = nil
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Replay seals the open segment and passes the events of sealed segments to
+// record, oldest first. It stops at the first segment that cannot be written so
+// that events are retried on the next call.
+func (s *spillLog) Replay(ctx context.Context, record func(context.Context, []AnalyticsEvent) error) error {
+	s.mu.Lock()
+	if err := s.sealLocked(); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	seqs := make([]uint64, 0, len(s.segments))
+	for seq := range s.segments {
+		seqs = append(seqs, seq)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	for _, seq := range seqs {
+		if err := s.replaySegment(ctx, record, seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *spillLog) replaySegment(ctx context.Context, record func(context.Context, []AnalyticsEvent) error, seq uint64) error {
+	path := s.segmentPath(seq)
+	events, err := readSpillSegment(path)
+	if err != nil {
+		return err
+	}
+
+	for done := 0; done < len(events); {
+		end := done + spillReplayBatch
+		if end > len(events) {
+			end = len(events)
+		}
+		if err := record(ctx, events[done:end]); err != nil {
+			// Keep only the events that were not written, so that the
+			// batches already committed are not counted twice.
+			if done > 0 {
+				if rerr := s.rewriteSegment(seq, events[done:]); rerr != nil {
+					log.Printf("Error rewriting spill segment %s: %v", path, rerr)
+				}
+			}
+			return err
+		}
+		s.mu.Lock()
+		s.replayed += uint64(end - done)
+		s.mu.Unlock()
+		done = end
+	}
+
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("removing replayed spill segment: %w", err)
+	}
+	s.mu.Lock()
+	delete(s.segments, seq)
+	s.mu.Unlock()
+	return nil
+}
+
+func readSpillSegment(path string) ([]AnalyticsEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening spill segment: %w", err)
+	}
+	defer f.Close()
+
+	var events []AnalyticsEvent
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var event AnalyticsEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			// A torn write from a crash leaves a partial last line.
+			log.Printf("Skipping corrupt analytics spill record in %s: %v", path, err)
+			continue
+		}
+		events = append(events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading spill segment: %w", err)
+	}
+	return events, nil
+}
+
+// rewriteSegment atomically replaces a sealed segment with the given events.
+func (s *spillLog) rewriteSegment(seq uint64, events []AnalyticsEvent) error {
+	path := s.segmentPath(seq)
+	tmp := path + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, event := range events {
+		if err := enc.Encode(event); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.segments[seq] = spillSegment{size: info.Size(), oldest: events[0].Timestamp}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *spillLog) Stats() SpillStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := SpillStats{
+		Segments:       len(s.segments),
+		SpilledEvents:  s.spilled,
+		ReplayedEvents: s.replayed,
+	}
+	var oldest time.Time
+	for _, seg := range s.segments {
+		stats.Bytes += seg.size
+		if !seg.oldest.IsZero() && (oldest.IsZero() || seg.oldest.Before(oldest)) {
+			oldest = seg.oldest
+		}
+	}
+	if !oldest.IsZero() {
+		stats.ReplayLag = time.Since(oldest)
+	}
+	return stats
+}
+
+func (s *spillLog) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sealLocked()
+}
+
+// spillReplayer periodically replays spilled analytics events into the store.
+func (us *URLShortener) spillReplayer(interval time.Duration) {
+	defer us.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-us.quit:
+			return
+		case <-ticker.C:
+			if us.spill.Stats().Segments == 0 {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(us.flushCtx, time.Minute)
+			if err := us.spill.Replay(ctx, us.recordEvents); err != nil {
+				log.Printf("Error replaying spilled analytics, will retry: %v", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// spillEvents writes events that could not be recorded to the spill log.
+// They are only lost if the spill log itself cannot be written.
+func (us *URLShortener) spillEvents(events ...AnalyticsEvent) {
+	us.prepareEvents(events)
+	if err := us.spill.Append(events...); err != nil {
+		log.Printf("Error spilling %d analytics events, dropping them: %v", len(events), err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrNotFound       = errors.New("short URL not found")
+	ErrShortCodeTaken = errors.New("short code already exists")
+	ErrLinkConsumed   = errors.New("single-use link already consumed")
+)
+
+// LinkKey identifies a link: short codes are unique per domain.
+type LinkKey struct {
+	Domain    string
+	ShortCode string
+}
+
+// Store is the persistence layer behind URLShortener. Lookups that find
+// nothing return ErrNotFound, and CreateURL returns ErrShortCodeTaken when
+// the short code is already in use on that domain. FindByLongURL only matches live links
+// without an expiry time, click budget or any other option. Deleted links are kept for their
+// analytics but are invisible to every lookup.
+type Store interface {
+	Migrate(ctx context.Context) error
+	ShortCodeExists(ctx context.Context, domain, shortCode string) (bool, error)
+	FindByLongURL(ctx context.Context, ownerID, domain, longURL string) (*URL, error)
+	CreateURL(ctx context.Context, u *URL) (*URL, error)
+	GetURL(ctx context.Context, domain, shortCode string) (*URL, error)
+	// UpdateURL persists the mutable fields of u: long_url, expires_at,
+	// max_clicks, archived_at, disabled_at, redirect_type, password_hash,
+	// active_from, active_until, fallback_url, targets, variants,
+	// query_forwarding, the UTM templates and title.
+	UpdateURL(ctx context.Context, u *URL) (*URL, error)
+	// ConsumeURL marks a single-use link consumed. It is atomic: only one
+	// call per link succeeds, later ones return ErrLinkConsumed.
+	ConsumeURL(ctx context.Context, domain, shortCode string, now time.Time) error
+	DeleteURL(ctx context.Context, domain, shortCode string, now time.Time) error
+	// FlagURL sets or, with a nil time, clears the threat list flag of a link.
+	FlagURL(ctx context.Context, domain, shortCode string, flaggedAt *time.Time) error
+	// ScanURLs returns up to limit live links with an ID above afterID, in
+	// ID order, for jobs that walk every link.
+	ScanURLs(ctx context.Context, afterID, limit int) ([]URL, error)
+	GetClicks(ctx context.Context, domain, shortCode string) (ClickCounts, error)
+	// AddClicks adds aggregated click deltas to the stored counts.
+	AddClicks(ctx context.Context, deltas map[LinkKey]ClickCounts) error
+	ListURLs(ctx context.Context, ownerID string, limit int) ([]URL, error)
+	// RecordEvents stores analytics rows and updates the hourly and daily
+	// rollups; it does not touch click counts.
+	RecordEvents(ctx context.Context, events []AnalyticsEvent) error
+	GetAnalytics(ctx context.Context, domain, shortCode string, limit int) ([]AnalyticsRecord, error)
+	// GetBreakdowns returns, for each of breakdownDimensions, the values
+	// with the most clicks, at most limit per dimension.
+	GetBreakdowns(ctx context.Context, domain, shortCode string, limit int) (map[string][]BreakdownEntry, error)
+	// GetTimeseries returns the non-empty rollup buckets of a link at the
+	// given interval ("hour" or "day") starting in [from, to).
+	GetTimeseries(ctx context.Context, domain, shortCode, interval string, from, to time.Time) ([]TimeseriesBucket, error)
+	// ArchiveExpired marks every link past its expiry time or click budget
+	// as archived and returns their keys.
+	ArchiveExpired(ctx context.Context, now time.Time) ([]LinkKey, error)
+
+	CreateAPIKey(ctx context.Context, key *APIKey) error
+	// GetAPIKeyByHash returns ErrAPIKeyNotFound for unknown keys.
+	GetAPIKeyByHash(ctx context.Context, keyHash string) (*APIKey, error)
+	RevokeAPIKey(ctx context.Context, prefix string, now time.Time) error
+
+	// PruneAnalytics deletes analytics rows from before the given time.
+	PruneAnalytics(ctx context.Context, before time.Time) (int64, error)
+	// DeleteAnalyticsByIP deletes the analytics rows of the given IPs,
+	// including rows stored as "ip:port" or "[ip]:port", and returns the
+	// number of rows deleted.
+	DeleteAnalyticsByIP(ctx context.Context, ips []string) (int64, error)
+	Close() error
+}
+
+func NewStore(cfg *Config) (Store, error) {
+	switch cfg.StorageBackend {
+	case "postgres":
+		return NewPostgresStore(cfg.DatabaseURL)
+	case "sqlite":
+		return NewSQLiteStore(cfg.SQLitePath)
+	case "memory":
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.StorageBackend)
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps everything in process memory. It is meant for tests and
+// local development; nothing survives a restart.
+type memoryStore struct {
+	mu              sync.RWMutex
+	urls            map[LinkKey]*URL
+	botClicks       map[LinkKey]int
+	deleted         map[LinkKey]time.Time
+	analytics       []memoryAnalytics
+	rollups         map[rollupKey]*TimeseriesBucket
+	apiKeys         map[string]*APIKey
+	nextURLID       int
+	nextAnalyticsID int
+	nextAPIKeyID    int
+}
+
+type memoryAnalytics struct {
+	key            LinkKey
+	referrerDomain string
+	AnalyticsRecord
+}
+
+// dimension returns the value of a breakdown column.
+func (a *memoryAnalytics) dimension(column string) string {
+	switch column {
+	case "referrer_domain":
+		return a.referrerDomain
+	case "browser":
+		return a.Browser
+	case "os":
+		return a.OS
+	case "device":
+		return a.Device
+	case "language":
+		return a.Language
+	case "country":
+		return a.Country
+	case "region":
+		return a.Region
+	case "city":
+		return a.City
+	case "target_rule":
+		return a.TargetRule
+	case "variant":
+		return a.Variant
+	}
+	return ""
+}
+
+func keyOf(u *URL) LinkKey {
+	return LinkKey{Domain: u.Domain, ShortCode: u.ShortCode}
+}
+
+func NewMemoryStore() Store {
+	return &memoryStore{
+		urls:      make(map[LinkKey]*URL),
+		botClicks: make(map[LinkKey]int),
+		deleted:   make(map[LinkKey]time.Time),
+		rollups:   make(map[rollupKey]*TimeseriesBucket),
+		apiKeys:   make(map[string]*APIKey),
+	}
+}
+
+func (m *memoryStore) Migrate(ctx context.Context) error {
+	return nil
+}
+
+func (m *memoryStore) ShortCodeExists(ctx context.Context, domain, shortCode string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, ok := m.urls[LinkKey{domain, shortCode}]
+	return ok, nil
+}
+
+// live returns the stored link for key unless it is missing or deleted.
+// Callers must hold m.mu.
+func (m *memoryStore) live(key LinkKey) (*URL, bool) {
+	u, ok := m.urls[key]
+	if !ok {
+		return nil, false
+	}
+	if _, deleted := m.deleted[key]; deleted {
+		return nil, false
+	}
+	return u, true
+}
+
+func (m *memoryStore) FindByLongURL(ctx context.Context, ownerID, domain, longURL string) (*URL, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for key, u := range m.urls {
+		if _, deleted := m.deleted[key]; deleted || key.Domain != domain {
+			continue
+		}
+		if u.LongURL == longURL && u.OwnerID == ownerID && u.ExpiresAt == nil && u.MaxClicks == nil && u.RedirectType == 0 && u.PasswordHash == "" && !u.SingleUse &&
+			u.ActiveFrom == nil && u.ActiveUntil == nil && u.FallbackURL == "" &&
+			len(u.Targets) == 0 && len(u.Variants) == 0 && u.QueryForwarding == "" && !u.hasUTM() && u.Title == "" && u.ArchivedAt == nil && u.DisabledAt == nil {
+			found := *u
+			return &found, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (m *memoryStore) CreateURL(ctx context.Context, u *URL) (*URL, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.urls[keyOf(u)]; ok {
+		return nil, ErrShortCodeTaken
+	}
+
+	m.nextURLID++
+	stored := *u
+	stored.ID = m.nextURLID
+	stored.Clicks = 0
+	stored.setPasswordHash(stored.PasswordHash)
+	stored.CreatedAt = time.Now().UTC()
+	m.urls[keyOf(u)] = &stored
+
+	created := stored
+	return &created, nil
+}
+
+func (m *memoryStore) GetURL(ctx context.Context, domain, shortCode string) (*URL, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	u, ok := m.live(LinkKey{domain, shortCode})
+	if !ok {
+		return nil, ErrNotFound
+	}
+	found := *u
+	return &found, nil
+}
+
+func (m *memoryStore) UpdateURL(ctx context.Context, u *URL) (*URL, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.live(keyOf(u))
+	if !ok {
+		return nil, ErrNotFound
+	}
+	stored.LongURL = u.LongURL
+	stored.ExpiresAt = u.ExpiresAt
+	stored.MaxClicks = u.MaxClicks
+	stored.ArchivedAt = u.ArchivedAt
+	stored.DisabledAt = u.DisabledAt
+	stored.RedirectType = u.RedirectType
+	stored.setPasswordHash(u.PasswordHash)
+	stored.ActiveFrom = u.ActiveFrom
+	stored.ActiveUntil = u.ActiveUntil
+	stored.FallbackURL = u.FallbackURL
+	stored.Targets = u.Targets
+	stored.Variants = u.Variants
+	stored.QueryForwarding = u.QueryForwarding
+	stored.Title = u.Title
+	stored.UTMSource, stored.UTMMedium, stored.UTMCampaign = u.UTMSource, u.UTMMedium, u.UTMCampaign
+
+	updated := *stored
+	return &updated, nil
+}
+
+func (m *memoryStore) ConsumeURL(ctx context.Context, domain, shortCode string, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.live(LinkKey{domain, shortCode})
+	if !ok || !u.SingleUse || u.ConsumedAt != nil {
+		return ErrLinkConsumed
+	}
+	u.ConsumedAt = &now
+	return nil
+}
+
+func (m *memoryStore) DeleteURL(ctx context.Context, domain, shortCode string, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := LinkKey{domain, shortCode}
+	if _, ok := m.live(key); !ok {
+		return ErrNotFound
+	}
+	m.deleted[key] = now
+	return nil
+}
+
+func (m *memoryStore) FlagURL(ctx context.Context, domain, shortCode string, flaggedAt *time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.live(LinkKey{domain, shortCode})
+	if !ok {
+		return ErrNotFound
+	}
+	u.FlaggedAt = flaggedAt
+	return nil
+}
+
+func (m *memoryStore) GetClicks(ctx context.Context, domain, shortCode string) (ClickCounts, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	key := LinkKey{domain, shortCode}
+	u, ok := m.live(key)
+	if !ok {
+		return ClickCounts{}, ErrNotFound
+	}
+	return ClickCounts{Total: u.Clicks, Bots: m.botClicks[key]}, nil
+}
+
+func (m *memoryStore) ListURLs(ctx context.Context, ownerID string, limit int) ([]URL, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	urls := make([]URL, 0, len(m.urls))
+	for key, u := range m.urls {
+		if _, deleted := m.deleted[key]; !deleted && u.OwnerID == ownerID {
+			urls = append(urls, *u)
+		}
+	}
+	sort.Slice(urls, func(i, j int) bool {
+		return urls[i].CreatedAt.After(urls[j].CreatedAt)
+	})
+
+	if len(urls) > limit {
+		urls = urls[:limit]
+	}
+	return urls, nil
+}
+
+func (m *memoryStore) ScanURLs(ctx context.Context, afterID, limit int) ([]URL, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	urls := make([]URL, 0, limit)
+	for key, u := range m.urls {
+		if _, deleted := m.deleted[key]; !deleted && u.ID > afterID {
+			urls = append(urls, *u)
+		}
+	}
+	sort.Slice(urls, func(i, j int) bool {
+		return urls[i].ID < urls[j].ID
+	})
+
+	if len(urls) > limit {
+		urls = urls[:limit]
+	}
+	return urls, nil
+}
+
+func (m *memoryStore) AddClicks(ctx context.Context, deltas map[LinkKey]ClickCounts) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, delta := range deltas {
+		if u, ok := m.urls[key]; ok {
+			u.Clicks += delta.Total
+			m.botClicks[key] += delta.Bots
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) RecordEvents(ctx context.Context, events []AnalyticsEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, event := range events {
+		key := LinkKey{event.Domain, event.ShortCode}
+		if _, ok := m.urls[key]; !ok {
+			continue
+		}
+
+		m.nextAnalyticsID++
+		m.analytics = append(m.analytics, memoryAnalytics{key, event.ReferrerDomain, AnalyticsRecord{
+			ID:        m.nextAnalyticsID,
+			ShortCode: event.ShortCode,
+			IPAddress: event.IPAddress,
+			UserAgent: event.UserAgent,
+			Referrer:  event.Referrer,
+			Language:  event.Language,
+			Browser:   event.Browser,
+			OS:        event.OS,
+			Device:    event.Device,
+			IsBot:     event.IsBot,
+			Country:   event.Country,
+			Region:    event.Region,
+			City:      event.City,
+			Timestamp: event.Timestamp,
+
+			TargetRule: event.TargetRule,
+			Variant:    event.Variant,
+		}})
+
+		for _, interval := range timeseriesIntervals {
+			rk := rollupKey{key, interval, bucketStart(event.Timestamp, interval)}
+			b := m.rollups[rk]
+			if b == nil {
+				b = &TimeseriesBucket{Start: rk.bucket}
+				m.rollups[rk] = b
+			}
+			b.Clicks++
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) GetAnalytics(ctx context.Context, domain, shortCode string, limit int) ([]AnalyticsRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	key := LinkKey{domain, shortCode}
+	var analytics []AnalyticsRecord
+	for i := len(m.analytics) - 1; i >= 0 && len(analytics) < limit; i-- {
+		if m.analytics[i].key == key {
+			analytics = append(analytics, m.analytics[i].AnalyticsRecord)
+		}
+	}
+	return analytics, nil
+}
+
+func (m *memoryStore) GetBreakdowns(ctx context.Context, domain, shortCode string, limit int) (map[string][]BreakdownEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	key := LinkKey{domain, shortCode}
+	breakdowns := make(map[string][]BreakdownEntry, len(breakdownDimensions))
+	for _, dim := range breakdownDimensions {
+		counts := make(map[string]int)
+		for i := range m.analytics {
+			if m.analytics[i].key == key {
+				counts[m.analytics[i].dimension(dim.column)]++
+			}
+		}
+
+		entries := []BreakdownEntry{}
+		for value, clicks := range counts {
+			entries = append(entries, BreakdownEntry{value, clicks})
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			if entries[i].Clicks != entries[j].Clicks {
+				return entries[i].Clicks > entries[j].Clicks
+			}
+			return entries[i].Value < entries[j].Value
+		})
+		if len(entries) > limit {
+			entries = entries[:limit]
+		}
+		for i := range entries {
+			entries[i].Value = breakdownLabel(dim.name, entries[i].Value)
+		}
+		breakdowns[dim.name] = entries
+	}
+	return breakdowns, nil
+}
+
+func (m *memoryStore) GetTimeseries(ctx context.Context, domain, shortCode, interval string, from, to time.Time) ([]TimeseriesBucket, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var buckets []TimeseriesBucket
+	for t := bucketStart(from, interval); t.Before(to); t = nextBucket(t, interval) {
+		if b := m.rollups[rollupKey{LinkKey{domain, shortCode}, interval, t}]; b != nil {
+			buckets = append(buckets, *b)
+		}
+	}
+	return buckets, nil
+}
+
+func (m *memoryStore) ArchiveExpired(ctx context.Context, now time.Time) ([]LinkKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var archived []LinkKey
+	for key, u := range m.urls {
+		if _, deleted := m.deleted[key]; deleted || u.ArchivedAt != nil {
+			continue
+		}
+		if (u.ExpiresAt != nil && !u.ExpiresAt.After(now)) || (u.MaxClicks != nil && u.Clicks >= *u.MaxClicks) {
+			archivedAt := now
+			u.ArchivedAt = &archivedAt
+			archived = append(archived, key)
+		}
+	}
+	return archived, nil
+}
+
+func (m *memoryStore) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextAPIKeyID++
+	key.ID = m.nextAPIKeyID
+	key.CreatedAt = time.Now().UTC()
+	stored := *key
+	m.apiKeys[key.KeyHash] = &stored
+	return nil
+}
+
+func (m *memoryStore) GetAPIKeyByHash(ctx context.Context, keyHash string) (*APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	key, ok := m.apiKeys[keyHash]
+	if !ok {
+		return nil, ErrAPIKeyNotFound
+	}
+	found := *key
+	return &found, nil
+}
+
+func (m *memoryStore) RevokeAPIKey(ctx context.Context, prefix string, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	revoked := false
+	for _, key := range m.apiKeys {
+		if key.Prefix == prefix && key.RevokedAt == nil {
+			revokedAt := now
+			key.RevokedAt = &revokedAt
+			revoked = true
+		}
+	}
+	if !revoked {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+func (m *memoryStore) PruneAnalytics(ctx context.Context, before time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	kept := m.analytics[:0]
+	for _, a := range m.analytics {
+		if !a.Timestamp.Before(before) {
+			kept = append(kept, a)
+		}
+	}
+	deleted := int64(len(m.analytics) - len(kept))
+	m.analytics = kept
+	return deleted, nil
+}
+
+func (m *memoryStore) DeleteAnalyticsByIP(ctx context.Context, ips []string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	match := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		match[ip] = true
+	}
+
+	kept := m.analytics[:0]
+	for _, a := range m.analytics {
+		stored := a.IPAddress
+		if host, _, err := net.SplitHostPort(stored); err == nil {
+			stored = host
+		}
+		if !match[stored] {
+			kept = append(kept, a)
+		}
+	}
+	deleted := int64(len(m.analytics) - len(kept))
+	m.analytics = kept
+	return deleted, nil
+}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
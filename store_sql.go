@@ -0,0 +1,812 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+type sqlDialect int
+
+const (
+	dialectPostgres sqlDialect = iota
+	dialectSQLite
+)
+
+var placeholderPattern = regexp.MustCompile(`\$(\d+)`)
+
+// sqlStore implements Store for both Postgres and SQLite. Queries are written
+// with Postgres-style $N placeholders and rebound for SQLite.
+type sqlStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+func NewPostgresStore(dbURL string) (Store, error) {
+	db, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	db.SetMaxOpenConns(50)
+	db.SetMaxIdleConns(15)
+	db.SetConnMaxLifetime(10 * time.Minute)
+
+	return &sqlStore{db: db, dialect: dialectPostgres}, nil
+}
+
+func NewSQLiteStore(path string) (Store, error) {
+	// The "sqlite" time format stores timestamps as
+	// "2006-01-02 15:04:05.999999999-07:00", so they compare in order.
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_time_format=sqlite")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database: %w", err)
+	}
+
+	// SQLite allows a single writer; serializing through one connection
+	// avoids "database is locked" errors under concurrent requests.
+	db.SetMaxOpenConns(1)
+
+	return &sqlStore{db: db, dialect: dialectSQLite}, nil
+}
+
+func (s *sqlStore) rebind(query string) string {
+	if s.dialect == dialectSQLite {
+		return placeholderPattern.ReplaceAllString(query, "?$1")
+	}
+	return query
+}
+
+func (s *sqlStore) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return s.db.ExecContext(ctx, s.rebind(query), args...)
+}
+
+func (s *sqlStore) query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return s.db.QueryContext(ctx, s.rebind(query), args...)
+}
+
+func (s *sqlStore) queryRow(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return s.db.QueryRowContext(ctx, s.rebind(query), args...)
+}
+
+func (s *sqlStore) Migrate(ctx context.Context) error {
+	idColumn := "id SERIAL PRIMARY KEY"
+	if s.dialect == dialectSQLite {
+		idColumn = "id INTEGER PRIMARY KEY AUTOINCREMENT"
+	}
+
+	urlsTable := `
+	CREATE TABLE IF NOT EXISTS urls (
+		` + idColumn + `,
+		short_code TEXT NOT NULL,
+		long_url TEXT NOT NULL,
+		clicks INTEGER DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		domain TEXT NOT NULL DEFAULT '',
+		UNIQUE (domain, short_code)
+	);`
+
+	analyticsTable := `
+	CREATE TABLE IF NOT EXISTS analytics (
+		` + idColumn + `,
+		short_code TEXT NOT NULL,
+		ip_address TEXT,
+		user_agent TEXT,
+		timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		domain TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY (domain, short_code) REFERENCES urls(domain, short_code)
+	);`
+
+	apiKeysTable := `
+	CREATE TABLE IF NOT EXISTS api_keys (
+		` + idColumn + `,
+		name TEXT NOT NULL DEFAULT '',
+		owner_id TEXT NOT NULL,
+		key_hash TEXT UNIQUE NOT NULL,
+		prefix TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		revoked_at TIMESTAMP
+	);`
+
+	// Rollups have no foreign key so that they can outlive the raw rows.
+	rollupTables := []string{`
+	CREATE TABLE IF NOT EXISTS analytics_hourly (
+		domain TEXT NOT NULL DEFAULT '',
+		short_code TEXT NOT NULL,
+		bucket TIMESTAMP NOT NULL,
+		clicks INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (domain, short_code, bucket)
+	);`, `
+	CREATE TABLE IF NOT EXISTS analytics_daily (
+		domain TEXT NOT NULL DEFAULT '',
+		short_code TEXT NOT NULL,
+		bucket TIMESTAMP NOT NULL,
+		clicks INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (domain, short_code, bucket)
+	);`,
+	}
+
+	indexQueries := []string{
+		`CREATE INDEX IF NOT EXISTS idx_urls_short_code ON urls(short_code);`,
+		`CREATE INDEX IF NOT EXISTS idx_urls_created_at ON urls(created_at DESC);`,
+		`CREATE INDEX IF NOT EXISTS idx_urls_long_url ON urls(long_url);`,
+		`CREATE INDEX IF NOT EXISTS idx_analytics_domain_short_code ON analytics(domain, short_code);`,
+		`CREATE INDEX IF NOT EXISTS idx_analytics_timestamp ON analytics(timestamp DESC);`,
+		`CREATE INDEX IF NOT EXISTS idx_urls_owner_id ON urls(owner_id, created_at DESC);`,
+		`CREATE INDEX IF NOT EXISTS idx_api_keys_prefix ON api_keys(prefix);`,
+	}
+
+	if _, err := s.exec(ctx, urlsTable); err != nil {
+		return err
+	}
+
+	if _, err := s.exec(ctx, analyticsTable); err != nil {
+		return err
+	}
+
+	if _, err := s.exec(ctx, apiKeysTable); err != nil {
+		return err
+	}
+
+	for _, table := range rollupTables {
+		if _, err := s.exec(ctx, table); err != nil {
+			return err
+		}
+	}
+
+	for _, column := range columnMigrations {
+		if err := s.addColumn(ctx, column.table, column.name, column.definition); err != nil {
+			return fmt.Errorf("failed to add column %s.%s: %w", column.table, column.name, err)
+		}
+	}
+
+	if err := s.migrateDomainKeys(ctx); err != nil {
+		return fmt.Errorf("failed to migrate to per-domain short codes: %w", err)
+	}
+
+	if err := s.migrateExactUniques(ctx); err != nil {
+		return fmt.Errorf("failed to remove exact unique visitor counts: %w", err)
+	}
+
+	for _, query := range indexQueries {
+		if _, err := s.exec(ctx, query); err != nil {
+			return fmt.Errorf("failed to create index: %w", err)
+		}
+	}
+
+	return nil
+}
+
+type columnMigration struct {
+	table      string
+	name       string
+	definition string
+}
+
+// columnMigrations lists columns added after the original schema. They are
+// applied in order on every start-up.
+var columnMigrations = []columnMigration{
+	{"urls", "expires_at", "TIMESTAMP"},
+	{"urls", "max_clicks", "INTEGER"},
+	{"urls", "archived_at", "TIMESTAMP"},
+	{"urls", "disabled_at", "TIMESTAMP"},
+	{"urls", "deleted_at", "TIMESTAMP"},
+	{"urls", "owner_id", "TEXT NOT NULL DEFAULT ''"},
+	{"urls", "domain", "TEXT NOT NULL DEFAULT ''"},
+	{"urls", "bot_clicks", "INTEGER NOT NULL DEFAULT 0"},
+	{"urls", "redirect_type", "INTEGER NOT NULL DEFAULT 0"},
+	{"urls", "password_hash", "TEXT NOT NULL DEFAULT ''"},
+	{"urls", "single_use", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	{"urls", "consumed_at", "TIMESTAMP"},
+	{"urls", "active_from", "TIMESTAMP"},
+	{"urls", "active_until", "TIMESTAMP"},
+	{"urls", "fallback_url", "TEXT NOT NULL DEFAULT ''"},
+	{"urls", "targets", "TEXT NOT NULL DEFAULT ''"},
+	{"urls", "variants", "TEXT NOT NULL DEFAULT ''"},
+	{"urls", "query_forwarding", "TEXT NOT NULL DEFAULT ''"},
+	{"urls", "utm_source", "TEXT NOT NULL DEFAULT ''"},
+	{"urls", "utm_medium", "TEXT NOT NULL DEFAULT ''"},
+	{"urls", "utm_campaign", "TEXT NOT NULL DEFAULT ''"},
+	{"urls", "title", "TEXT NOT NULL DEFAULT ''"},
+	{"urls", "flagged_at", "TIMESTAMP"},
+	{"analytics", "domain", "TEXT NOT NULL DEFAULT ''"},
+	{"analytics", "referrer", "TEXT NOT NULL DEFAULT ''"},
+	{"analytics", "referrer_domain", "TEXT NOT NULL DEFAULT ''"},
+	{"analytics", "language", "TEXT NOT NULL DEFAULT ''"},
+	{"analytics", "browser", "TEXT NOT NULL DEFAULT ''"},
+	{"analytics", "os", "TEXT NOT NULL DEFAULT ''"},
+	{"analytics", "device", "TEXT NOT NULL DEFAULT ''"},
+	{"analytics", "is_bot", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	{"analytics", "country", "TEXT NOT NULL DEFAULT ''"},
+	{"analytics", "region", "TEXT NOT NULL DEFAULT ''"},
+	{"analytics", "city", "TEXT NOT NULL DEFAULT ''"},
+	{"analytics", "target_rule", "TEXT NOT NULL DEFAULT ''"},
+	{"analytics", "variant", "TEXT NOT NULL DEFAULT ''"},
+	{"api_keys", "is_admin", "BOOLEAN NOT NULL DEFAULT FALSE"},
+}
+
+// addColumn adds a column to an existing table if it is not already there.
+// SQLite has no ADD COLUMN IF NOT EXISTS, so the table info is checked first.
+func (s *sqlStore) addColumn(ctx context.Context, table, column, definition string) error {
+	if s.dialect == dialectPostgres {
+		_, err := s.exec(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s", table, column, definition))
+		return err
+	}
+
+	var count int
+	err := s.queryRow(ctx, "SELECT COUNT(*) FROM pragma_table_info($1) WHERE name = $2", table, column).Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+	_, err = s.exec(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+func (s *sqlStore) dropColumn(ctx context.Context, table, column string) error {
+	if s.dialect == dialectPostgres {
+		_, err := s.exec(ctx, fmt.Sprintf("ALTER TABLE %s DROP COLUMN IF EXISTS %s", table, column))
+		return err
+	}
+
+	var count int
+	err := s.queryRow(ctx, "SELECT COUNT(*) FROM pragma_table_info($1) WHERE name = $2", table, column).Scan(&count)
+	if err != nil || count == 0 {
+		return err
+	}
+	_, err = s.exec(ctx, fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", table, column))
+	return err
+}
+
+// migrateExactUniques removes what databases created before unique visitors
+// were estimated from HyperLogLog sketches used to count them exactly: the
+// analytics_visitors table and the unique_visitors column of the rollups.
+func (s *sqlStore) migrateExactUniques(ctx context.Context) error {
+	if _, err := s.exec(ctx, "DROP TABLE IF EXISTS analytics_visitors"); err != nil {
+		return err
+	}
+	for _, interval := range timeseriesIntervals {
+		if err := s.dropColumn(ctx, rollupTable[interval], "unique_visitors"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateDomainKeys converts databases created before branded domains, where
+// short_code alone was unique and referenced by analytics, to the
+// (domain, short_code) key.
+func (s *sqlStore) migrateDomainKeys(ctx context.Context) error {
+	if s.dialect == dialectPostgres {
+		_, err := s.exec(ctx, `
+		DO $$
+		BEGIN
+			IF EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'urls_short_code_key') THEN
+				ALTER TABLE analytics DROP CONSTRAINT IF EXISTS analytics_short_code_fkey;
+				ALTER TABLE urls DROP CONSTRAINT urls_short_code_key;
+				ALTER TABLE urls ADD CONSTRAINT urls_domain_short_code_key UNIQUE (domain, short_code);
+				ALTER TABLE analytics ADD CONSTRAINT analytics_domain_short_code_fkey
+					FOREIGN KEY (domain, short_code) REFERENCES urls(domain, short_code);
+			END IF;
+		END $$;`)
+		return err
+	}
+
+	// SQLite cannot drop constraints, so both tables are rebuilt from their
+	// stored definitions with the keys rewritten.
+	var urlsSQL string
+	if err := s.queryRow(ctx, "SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'urls'").Scan(&urlsSQL); err != nil {
+		return err
+	}
+	if !strings.Contains(urlsSQL, "short_code TEXT UNIQUE NOT NULL") {
+		return nil
+	}
+	var analyticsSQL string
+	if err := s.queryRow(ctx, "SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'analytics'").Scan(&analyticsSQL); err != nil {
+		return err
+	}
+
+	urlsSQL = strings.Replace(urlsSQL, "short_code TEXT UNIQUE NOT NULL", "short_code TEXT NOT NULL", 1)
+	urlsSQL = urlsSQL[:strings.LastIndex(urlsSQL, ")")] + ",\n\t\tUNIQUE (domain, short_code)\n\t)"
+	analyticsSQL = strings.Replace(analyticsSQL,
+		"FOREIGN KEY (short_code) REFERENCES urls(short_code)",
+		"FOREIGN KEY (domain, short_code) REFERENCES urls(domain, short_code)", 1)
+
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), "PRAGMA foreign_keys = ON")
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for table, createSQL := range map[string]string{"urls": urlsSQL, "analytics": analyticsSQL} {
+		statements := []string{
+			strings.Replace(createSQL, "CREATE TABLE "+table, "CREATE TABLE "+table+"_new", 1),
+			fmt.Sprintf("INSERT INTO %s_new SELECT * FROM %s", table, table),
+			fmt.Sprintf("DROP TABLE %s", table),
+			fmt.Sprintf("ALTER TABLE %s_new RENAME TO %s", table, table),
+		}
+		for _, statement := range statements {
+			if _, err := tx.ExecContext(ctx, statement); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+const urlColumns = "id, short_code, long_url, clicks, created_at, expires_at, max_clicks, archived_at, disabled_at, owner_id, domain, redirect_type, password_hash, single_use, consumed_at, active_from, active_until, fallback_url, targets, variants, query_forwarding, utm_source, utm_medium, utm_campaign, title, flagged_at"
+
+func scanURL(row interface{ Scan(...interface{}) error }) (*URL, error) {
+	var u URL
+	var targets, variants string
+	if err := row.Scan(&u.ID, &u.ShortCode, &u.LongURL, &u.Clicks, &u.CreatedAt, &u.ExpiresAt, &u.MaxClicks, &u.ArchivedAt, &u.DisabledAt, &u.OwnerID, &u.Domain, &u.RedirectType, &u.PasswordHash, &u.SingleUse, &u.ConsumedAt, &u.ActiveFrom, &u.ActiveUntil, &u.FallbackURL, &targets, &variants, &u.QueryForwarding, &u.UTMSource, &u.UTMMedium, &u.UTMCampaign, &u.Title, &u.FlaggedAt); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if targets != "" {
+		if err := json.Unmarshal([]byte(targets), &u.Targets); err != nil {
+			return nil, fmt.Errorf("decoding targets of %s: %w", u.ShortCode, err)
+		}
+	}
+	if variants != "" {
+		if err := json.Unmarshal([]byte(variants), &u.Variants); err != nil {
+			return nil, fmt.Errorf("decoding variants of %s: %w", u.ShortCode, err)
+		}
+	}
+	u.setPasswordHash(u.PasswordHash)
+	return &u, nil
+}
+
+// encodeList stores list options such as targeting rules as JSON, or ""
+// when the list is empty.
+func encodeList[T any](list []T) string {
+	if len(list) == 0 {
+		return ""
+	}
+	encoded, _ := json.Marshal(list)
+	return string(encoded)
+}
+
+func (s *sqlStore) ShortCodeExists(ctx context.Context, domain, shortCode string) (bool, error) {
+	var count int
+	err := s.queryRow(ctx, "SELECT COUNT(*) FROM urls WHERE domain = $1 AND short_code = $2", domain, shortCode).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (s *sqlStore) FindByLongURL(ctx context.Context, ownerID, domain, longURL string) (*URL, error) {
+	return scanURL(s.queryRow(ctx,
+		`SELECT `+urlColumns+` FROM urls
+		 WHERE long_url = $1 AND owner_id = $2 AND domain = $3 AND expires_at IS NULL AND max_clicks IS NULL AND redirect_type = 0 AND password_hash = '' AND single_use = FALSE
+		   AND active_from IS NULL AND active_until IS NULL AND fallback_url = '' AND targets = '' AND variants = ''
+		   AND query_forwarding = '' AND utm_source = '' AND utm_medium = '' AND utm_campaign = '' AND title = ''
+		   AND archived_at IS NULL AND disabled_at IS NULL AND deleted_at IS NULL`,
+		longURL, ownerID, domain))
+}
+
+func isUniqueViolation(err error) bool {
+	switch e := err.(type) {
+	case *pq.Error:
+		return e.Code == "23505"
+	case *sqlite.Error:
+		return e.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+	}
+	return false
+}
+
+func (s *sqlStore) CreateURL(ctx context.Context, u *URL) (*URL, error) {
+	created, err := scanURL(s.queryRow(ctx,
+		`INSERT INTO urls (short_code, long_url, expires_at, max_clicks, owner_id, domain, redirect_type, password_hash, single_use, active_from, active_until, fallback_url, targets, variants,
+		                   query_forwarding, utm_source, utm_medium, utm_campaign, title)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19) RETURNING `+urlColumns,
+		u.ShortCode, u.LongURL, u.ExpiresAt, u.MaxClicks, u.OwnerID, u.Domain, u.RedirectType, u.PasswordHash, u.SingleUse, u.ActiveFrom, u.ActiveUntil, u.FallbackURL,
+		encodeList(u.Targets), encodeList(u.Variants), u.QueryForwarding, u.UTMSource, u.UTMMedium, u.UTMCampaign, u.Title))
+	if isUniqueViolation(err) {
+		return nil, ErrShortCodeTaken
+	}
+	return created, err
+}
+
+func (s *sqlStore) GetURL(ctx context.Context, domain, shortCode string) (*URL, error) {
+	return scanURL(s.queryRow(ctx,
+		"SELECT "+urlColumns+" FROM urls WHERE domain = $1 AND short_code = $2 AND deleted_at IS NULL",
+		domain, shortCode))
+}
+
+func (s *sqlStore) UpdateURL(ctx context.Context, u *URL) (*URL, error) {
+	return scanURL(s.queryRow(ctx,
+		`UPDATE urls SET long_url = $3, expires_at = $4, max_clicks = $5, archived_at = $6, disabled_at = $7, redirect_type = $8, password_hash = $9,
+		     active_from = $10, active_until = $11, fallback_url = $12, targets = $13, variants = $14,
+		     query_forwarding = $15, utm_source = $16, utm_medium = $17, utm_campaign = $18, title = $19
+		 WHERE domain = $1 AND short_code = $2 AND deleted_at IS NULL
+		 RETURNING `+urlColumns,
+		u.Domain, u.ShortCode, u.LongURL, u.ExpiresAt, u.MaxClicks, u.ArchivedAt, u.DisabledAt, u.RedirectType, u.PasswordHash,
+		u.ActiveFrom, u.ActiveUntil, u.FallbackURL, encodeList(u.Targets), encodeList(u.Variants),
+		u.QueryForwarding, u.UTMSource, u.UTMMedium, u.UTMCampaign, u.Title))
+}
+
+// ConsumeURL relies on the conditional UPDATE: the row lock (Postgres) or
+// database lock (SQLite) serializes concurrent calls, and only the first
+// still sees consumed_at IS NULL.
+func (s *sqlStore) ConsumeURL(ctx context.Context, domain, shortCode string, now time.Time) error {
+	result, err := s.exec(ctx,
+		`UPDATE urls SET consumed_at = $3
+		 WHERE domain = $1 AND short_code = $2 AND single_use = TRUE AND consumed_at IS NULL AND deleted_at IS NULL`,
+		domain, shortCode, now)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrLinkConsumed
+	}
+	return nil
+}
+
+func (s *sqlStore) DeleteURL(ctx context.Context, domain, shortCode string, now time.Time) error {
+	result, err := s.exec(ctx,
+		"UPDATE urls SET deleted_at = $3 WHERE domain = $1 AND short_code = $2 AND deleted_at IS NULL",
+		domain, shortCode, now)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) FlagURL(ctx context.Context, domain, shortCode string, flaggedAt *time.Time) error {
+	result, err := s.exec(ctx,
+		"UPDATE urls SET flagged_at = $3 WHERE domain = $1 AND short_code = $2 AND deleted_at IS NULL",
+		domain, shortCode, flaggedAt)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) GetClicks(ctx context.Context, domain, shortCode string) (ClickCounts, error) {
+	var clicks ClickCounts
+	err := s.queryRow(ctx,
+		"SELECT clicks, bot_clicks FROM urls WHERE domain = $1 AND short_code = $2 AND deleted_at IS NULL",
+		domain, shortCode).Scan(&clicks.Total, &clicks.Bots)
+	if err == sql.ErrNoRows {
+		return ClickCounts{}, ErrNotFound
+	}
+	return clicks, err
+}
+
+func (s *sqlStore) ListURLs(ctx context.Context, ownerID string, limit int) ([]URL, error) {
+	rows, err := s.query(ctx,
+		"SELECT "+urlColumns+" FROM urls WHERE owner_id = $1 AND deleted_at IS NULL ORDER BY created_at DESC LIMIT $2",
+		ownerID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var urls []URL
+	for rows.Next() {
+		u, err := scanURL(rows)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, *u)
+	}
+
+	return urls, rows.Err()
+}
+
+func (s *sqlStore) ScanURLs(ctx context.Context, afterID, limit int) ([]URL, error) {
+	rows, err := s.query(ctx,
+		"SELECT "+urlColumns+" FROM urls WHERE id > $1 AND deleted_at IS NULL ORDER BY id LIMIT $2",
+		afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var urls []URL
+	for rows.Next() {
+		u, err := scanURL(rows)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, *u)
+	}
+
+	return urls, rows.Err()
+}
+
+func (s *sqlStore) AddClicks(ctx context.Context, deltas map[LinkKey]ClickCounts) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("starting clicks transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, s.rebind("UPDATE urls SET clicks = clicks + $1, bot_clicks = bot_clicks + $2 WHERE domain = $3 AND short_code = $4"))
+	if err != nil {
+		return fmt.Errorf("preparing clicks statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for key, delta := range deltas {
+		if _, err := stmt.ExecContext(ctx, delta.Total, delta.Bots, key.Domain, key.ShortCode); err != nil {
+			return fmt.Errorf("adding clicks for %s: %w", key.ShortCode, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing clicks: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStore) RecordEvents(ctx context.Context, events []AnalyticsEvent) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("starting analytics transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	insertStmt, err := tx.PrepareContext(ctx, s.rebind(`INSERT INTO analytics
+		(domain, short_code, ip_address, user_agent, referrer, referrer_domain, language, browser, os, device, is_bot, country, region, city, timestamp, target_rule, variant)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)`))
+	if err != nil {
+		return fmt.Errorf("preparing insert statement: %w", err)
+	}
+	defer insertStmt.Close()
+
+	// Any statement error fails the whole batch so the caller can spill and
+	// retry it; Postgres aborts the transaction on the first error anyway.
+	clicks := make(map[rollupKey]int)
+	for _, event := range events {
+		_, err := insertStmt.ExecContext(ctx, event.Domain, event.ShortCode, event.IPAddress, event.UserAgent,
+			event.Referrer, event.ReferrerDomain, event.Language, event.Browser, event.OS, event.Device, event.IsBot,
+			event.Country, event.Region, event.City, event.Timestamp, event.TargetRule, event.Variant)
+		if err != nil {
+			return fmt.Errorf("inserting analytics for %s: %w", event.ShortCode, err)
+		}
+
+		for _, interval := range timeseriesIntervals {
+			clicks[rollupKey{LinkKey{event.Domain, event.ShortCode}, interval, bucketStart(event.Timestamp, interval)}]++
+		}
+	}
+
+	for key, n := range clicks {
+		table := rollupTable[key.interval]
+		_, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO `+table+` (domain, short_code, bucket, clicks) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (domain, short_code, bucket) DO UPDATE SET clicks = `+table+`.clicks + excluded.clicks`),
+			key.link.Domain, key.link.ShortCode, key.bucket, n)
+		if err != nil {
+			return fmt.Errorf("updating %s rollup for %s: %w", key.interval, key.link.ShortCode, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing analytics batch: %w", err)
+	}
+	return nil
+}
+
+func (s *sqlStore) GetAnalytics(ctx context.Context, domain, shortCode string, limit int) ([]AnalyticsRecord, error) {
+	rows, err := s.query(ctx,
+		`SELECT id, short_code, ip_address, user_agent, referrer, language, browser, os, device, is_bot, country, region, city, timestamp, target_rule, variant
+		FROM analytics WHERE domain = $1 AND short_code = $2 ORDER BY timestamp DESC LIMIT $3`,
+		domain, shortCode, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var analytics []AnalyticsRecord
+	for rows.Next() {
+		var record AnalyticsRecord
+		err := rows.Scan(&record.ID, &record.ShortCode, &record.IPAddress, &record.UserAgent,
+			&record.Referrer, &record.Language, &record.Browser, &record.OS, &record.Device, &record.IsBot,
+			&record.Country, &record.Region, &record.City, &record.Timestamp, &record.TargetRule, &record.Variant)
+		if err != nil {
+			return nil, err
+		}
+		analytics = append(analytics, record)
+	}
+
+	return analytics, rows.Err()
+}
+
+func (s *sqlStore) GetBreakdowns(ctx context.Context, domain, shortCode string, limit int) (map[string][]BreakdownEntry, error) {
+	breakdowns := make(map[string][]BreakdownEntry, len(breakdownDimensions))
+	for _, dim := range breakdownDimensions {
+		rows, err := s.query(ctx,
+			"SELECT "+dim.column+", COUNT(*) AS clicks FROM analytics WHERE domain = $1 AND short_code = $2 GROUP BY "+dim.column+" ORDER BY clicks DESC, "+dim.column+" LIMIT $3",
+			domain, shortCode, limit)
+		if err != nil {
+			return nil, err
+		}
+
+		entries := []BreakdownEntry{}
+		for rows.Next() {
+			var entry BreakdownEntry
+			if err := rows.Scan(&entry.Value, &entry.Clicks); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			entry.Value = breakdownLabel(dim.name, entry.Value)
+			entries = append(entries, entry)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		breakdowns[dim.name] = entries
+	}
+	return breakdowns, nil
+}
+
+var rollupTable = map[string]string{
+	"hour": "analytics_hourly",
+	"day":  "analytics_daily",
+}
+
+func (s *sqlStore) GetTimeseries(ctx context.Context, domain, shortCode, interval string, from, to time.Time) ([]TimeseriesBucket, error) {
+	table, ok := rollupTable[interval]
+	if !ok {
+		return nil, fmt.Errorf("unknown interval %q", interval)
+	}
+
+	rows, err := s.query(ctx,
+		"SELECT bucket, clicks FROM "+table+" WHERE domain = $1 AND short_code = $2 AND bucket >= $3 AND bucket < $4 ORDER BY bucket",
+		domain, shortCode, from.UTC(), to.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var buckets []TimeseriesBucket
+	for rows.Next() {
+		var b TimeseriesBucket
+		if err := rows.Scan(&b.Start, &b.Clicks); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+func (s *sqlStore) ArchiveExpired(ctx context.Context, now time.Time) ([]LinkKey, error) {
+	rows, err := s.query(ctx, `
+		UPDATE urls SET archived_at = $1
+		WHERE archived_at IS NULL AND deleted_at IS NULL
+		  AND ((expires_at IS NOT NULL AND expires_at <= $1)
+		    OR (max_clicks IS NOT NULL AND clicks >= max_clicks))
+		RETURNING domain, short_code`, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var archived []LinkKey
+	for rows.Next() {
+		var key LinkKey
+		if err := rows.Scan(&key.Domain, &key.ShortCode); err != nil {
+			return nil, err
+		}
+		archived = append(archived, key)
+	}
+
+	return archived, rows.Err()
+}
+
+func (s *sqlStore) CreateAPIKey(ctx context.Context, key *APIKey) error {
+	return s.queryRow(ctx,
+		"INSERT INTO api_keys (name, owner_id, key_hash, prefix, is_admin) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at",
+		key.Name, key.OwnerID, key.KeyHash, key.Prefix, key.Admin,
+	).Scan(&key.ID, &key.CreatedAt)
+}
+
+func (s *sqlStore) GetAPIKeyByHash(ctx context.Context, keyHash string) (*APIKey, error) {
+	var key APIKey
+	err := s.queryRow(ctx,
+		"SELECT id, name, owner_id, key_hash, prefix, is_admin, created_at, revoked_at FROM api_keys WHERE key_hash = $1",
+		keyHash,
+	).Scan(&key.ID, &key.Name, &key.OwnerID, &key.KeyHash, &key.Prefix, &key.Admin, &key.CreatedAt, &key.RevokedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (s *sqlStore) RevokeAPIKey(ctx context.Context, prefix string, now time.Time) error {
+	result, err := s.exec(ctx, "UPDATE api_keys SET revoked_at = $2 WHERE prefix = $1 AND revoked_at IS NULL", prefix, now)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) PruneAnalytics(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.exec(ctx, "DELETE FROM analytics WHERE timestamp < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *sqlStore) DeleteAnalyticsByIP(ctx context.Context, ips []string) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var deleted int64
+	for _, ip := range ips {
+		// Rows may carry a port: ip:port for IPv4, [ip]:port for IPv6. An
+		// IPv6 address followed by ":%" would also match longer addresses.
+		withPort := "[" + ip + "]:%"
+		if !strings.Contains(ip, ":") {
+			withPort = ip + ":%"
+		}
+		result, err := tx.ExecContext(ctx,
+			s.rebind("DELETE FROM analytics WHERE ip_address = $1 OR ip_address LIKE $2"),
+			ip, withPort)
+		if err != nil {
+			return 0, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		deleted += n
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
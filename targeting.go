@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Targeting rules send visitors of one link to different destinations. The
+// rules are checked in order and the first one matching the visitor wins;
+// visitors matching none go to long_url. A rule matches when every condition
+// it sets matches, and a condition matches when the visitor has any of its
+// values:
+//
+//	platforms  operating system parsed from the User-Agent, e.g. "iOS"
+//	countries  ISO country code, from the COUNTRY_HEADER request header or
+//	           else the GeoIP database
+//	languages  primary language of Accept-Language, e.g. "de"
+//
+// The name of the matching rule is recorded in analytics.
+
+const maxTargetRules = 20
+
+// TargetRule is one targeting rule of a link. Rules created without a name
+// are named after their position, starting at "1".
+type TargetRule struct {
+	Name      string   `json:"name"`
+	Platforms []string `json:"platforms,omitempty"`
+	Countries []string `json:"countries,omitempty"`
+	Languages []string `json:"languages,omitempty"`
+	URL       string   `json:"url"`
+}
+
+// targetPlatforms are the platforms rules may name: the OS names reported by
+// parseUserAgent.
+var targetPlatforms = func() map[string]string {
+	platforms := make(map[string]string)
+	for _, o := range userAgentOSes {
+		platforms[strings.ToLower(o.name)] = o.name
+	}
+	return platforms
+}()
+
+// normalizeTargetRules validates rules and canonicalizes their values in
+// place.
+func normalizeTargetRules(rules []TargetRule) error {
+	if len(rules) > maxTargetRules {
+		return fmt.Errorf("at most %d targeting rules are allowed", maxTargetRules)
+	}
+
+	names := make(map[string]bool, len(rules))
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Name == "" {
+			rule.Name = strconv.Itoa(i + 1)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("targeting rule name %q is used twice", rule.Name)
+		}
+		names[rule.Name] = true
+
+		if !isValidURL(rule.URL) {
+			return fmt.Errorf("targeting rule %q: invalid URL format", rule.Name)
+		}
+		if len(rule.Platforms) == 0 && len(rule.Countries) == 0 && len(rule.Languages) == 0 {
+			return fmt.Errorf("targeting rule %q has no conditions", rule.Name)
+		}
+
+		for j, platform := range rule.Platforms {
+			name, ok := targetPlatforms[strings.ToLower(platform)]
+			if !ok {
+				return fmt.Errorf("targeting rule %q: unknown platform %q", rule.Name, platform)
+			}
+			rule.Platforms[j] = name
+		}
+		for j, country := range rule.Countries {
+			if len(country) != 2 {
+				return fmt.Errorf("targeting rule %q: countries must be ISO 3166-1 alpha-2 codes", rule.Name)
+			}
+			rule.Countries[j] = strings.ToUpper(country)
+		}
+		for j, language := range rule.Languages {
+			rule.Languages[j] = primaryLanguage(language)
+			if rule.Languages[j] == "" {
+				return fmt.Errorf("targeting rule %q: invalid language %q", rule.Name, language)
+			}
+		}
+	}
+	return nil
+}
+
+// visitorTraits are the request properties targeting rules match on. The
+// country is only looked up when a rule needs it.
+type visitorTraits struct {
+	us       *URLShortener
+	r        *http.Request
+	platform string
+	language string
+
+	country       string
+	countryLoaded bool
+}
+
+func (us *URLShortener) newVisitorTraits(r *http.Request) *visitorTraits {
+	return &visitorTraits{
+		us:       us,
+		r:        r,
+		platform: parseUserAgent(r.UserAgent()).OS,
+		language: primaryLanguage(r.Header.Get("Accept-Language")),
+	}
+}
+
+func (v *visitorTraits) Country() string {
+	if !v.countryLoaded {
+		v.countryLoaded = true
+		if header := v.us.cfg.CountryHeader; header != "" {
+			v.country = strings.ToUpper(strings.TrimSpace(v.r.Header.Get(header)))
+		}
+		if len(v.country) != 2 {
+			v.country = v.us.geo.Lookup(clientAddress(v.r)).Country
+		}
+	}
+	return v.country
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *TargetRule) matches(v *visitorTraits) bool {
+	if len(rule.Platforms) > 0 && !containsFold(rule.Platforms, v.platform) {
+		return false
+	}
+	if len(rule.Languages) > 0 && !containsFold(rule.Languages, v.language) {
+		return false
+	}
+	if len(rule.Countries) > 0 && !containsFold(rule.Countries, v.Country()) {
+		return false
+	}
+	return true
+}
+
+// selectTarget returns the destination of u for the visitor making r and
+// the name of the targeting rule that chose it, or "" for long_url.
+func (us *URLShortener) selectTarget(r *http.Request, u *URL) (string, string) {
+	if len(u.Targets) == 0 {
+		return u.LongURL, ""
+	}
+	visitor := us.newVisitorTraits(r)
+	for i := range u.Targets {
+		if u.Targets[i].matches(visitor) {
+			return u.Targets[i].URL, u.Targets[i].Name
+		}
+	}
+	return u.LongURL, ""
+}
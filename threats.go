@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// THREAT_LIST_SOURCE names a local list of phishing and malware URLs: a file
+// path, or an http:// URL such as a sidecar that syncs a Safe Browsing list.
+// It is reloaded every THREAT_LIST_REFRESH_INTERVAL. Each line is either
+//
+//	# a comment
+//	evil.example/               a URL expression: host and optional path
+//	1f0e3dad                    a hex SHA-256 prefix (4 to 32 bytes) of one
+//
+// as in the Safe Browsing Update API v4: a URL matches when the hash of any
+// of its host suffix and path prefix expressions starts with a listed
+// prefix. An expression without a path covers the whole host and its
+// subdomains. Prefixes are not confirmed against full hashes, so the list
+// should hold full hashes or prefixes long enough to make collisions rare.
+//
+// Destinations on the list are rejected by ShortenURL and UpdateLink. When
+// the list changes, every stored link is checked again: links newly on the
+// list are flagged and show a warning page instead of redirecting, and links
+// no longer on it are cleared.
+
+const (
+	maxThreatListSize = 64 << 20
+	recheckBatchSize  = 500
+)
+
+// threatList holds the loaded hash prefixes. A nil *threatList matches
+// nothing, so callers need not check whether a list is configured.
+type threatList struct {
+	source string
+	client *http.Client
+
+	mu       sync.RWMutex
+	prefixes map[int]map[string]bool // by prefix length in bytes
+	version  string
+}
+
+// openThreatList loads the list at source. A list that cannot be loaded is
+// logged and retried on the next refresh; until then nothing is blocked.
+func openThreatList(source string) *threatList {
+	if source == "" {
+		return nil
+	}
+	t := &threatList{source: source, client: &http.Client{Timeout: 30 * time.Second}}
+	if _, err := t.Refresh(context.Background()); err != nil {
+		log.Printf("Error loading threat list, destinations are not checked until it loads: %v", err)
+	}
+	return t
+}
+
+func (t *threatList) read(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(t.source, "http://") && !strings.HasPrefix(t.source, "https://") {
+		return os.ReadFile(t.source)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.source, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", t.source, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxThreatListSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxThreatListSize {
+		return nil, fmt.Errorf("fetching %s: list is larger than %d bytes", t.source, maxThreatListSize)
+	}
+	return data, nil
+}
+
+// Refresh reloads the list and reports whether its contents changed.
+func (t *threatList) Refresh(ctx context.Context) (bool, error) {
+	data, err := t.read(ctx)
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256(data)
+	version := hex.EncodeToString(sum[:8])
+
+	t.mu.RLock()
+	unchanged := version == t.version
+	t.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	prefixes, count, err := parseThreatList(data)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", t.source, err)
+	}
+
+	t.mu.Lock()
+	t.prefixes, t.version = prefixes, version
+	t.mu.Unlock()
+
+	log.Printf("Loaded threat list %s with %d entries (version %s)", t.source, count, version)
+	return true, nil
+}
+
+func parseThreatList(data []byte) (map[int]map[string]bool, int, error) {
+	prefixes := make(map[int]map[string]bool)
+	count := 0
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		prefix, err := threatPrefix(line)
+		if err != nil {
+			return nil, 0, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		if prefixes[len(prefix)] == nil {
+			prefixes[len(prefix)] = make(map[string]bool)
+		}
+		prefixes[len(prefix)][prefix] = true
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	return prefixes, count, nil
+}
+
+// threatPrefix returns the hash prefix a list entry stands for. Hex strings
+// without dots are prefixes already; anything else is a URL expression and
+// stands for its full hash.
+func threatPrefix(entry string) (string, error) {
+	if !strings.ContainsAny(entry, "./") {
+		raw, err := hex.DecodeString(entry)
+		if err != nil || len(raw) < 4 || len(raw) > sha256.Size {
+			return "", fmt.Errorf("%q is neither a URL expression nor a 4 to 32 byte hex hash prefix", entry)
+		}
+		return string(raw), nil
+	}
+
+	expression := entry
+	for _, scheme := range []string{"http://", "https://"} {
+		expression = strings.TrimPrefix(expression, scheme)
+	}
+	host, path, _ := strings.Cut(expression, "/")
+	sum := sha256.Sum256([]byte(normalizeHost(host) + "/" + path))
+	return string(sum[:]), nil
+}
+
+// threatExpressions returns the host suffix and path prefix expressions
+// of a URL, following the Safe Browsing lookup rules: the exact host and up
+// to four suffixes of its last five components, each combined with the
+// exact path, with and without the query, and up to four leading
+// directories.
+func threatExpressions(raw string) []string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil
+	}
+
+	host := normalizeHost(u.Hostname())
+	hosts := []string{host}
+	if net.ParseIP(host) == nil {
+		parts := strings.Split(host, ".")
+		start := len(parts) - 5
+		if start < 1 {
+			start = 1
+		}
+		for i := start; i < len(parts)-1; i++ {
+			hosts = append(hosts, strings.Join(parts[i:], "."))
+		}
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	var paths []string
+	if u.RawQuery != "" {
+		paths = append(paths, path+"?"+u.RawQuery)
+	}
+	paths = append(paths, path)
+	dir := "/"
+	paths = append(paths, dir)
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i := 0; i < len(segments)-1 && i < 3; i++ {
+		dir += segments[i] + "/"
+		paths = append(paths, dir)
+	}
+
+	seen := make(map[string]bool)
+	var expressions []string
+	for _, h := range hosts {
+		for _, p := range paths {
+			if expression := h + p; !seen[expression] {
+				seen[expression] = true
+				expressions = append(expressions, expression)
+			}
+		}
+	}
+	return expressions
+}
+
+// Loaded reports whether a list has been loaded.
+func (t *threatList) Loaded() bool {
+	if t == nil {
+		return false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.version != ""
+}
+
+// Match reports whether a URL is on the list.
+func (t *threatList) Match(raw string) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for _, expression := range threatExpressions(raw) {
+		sum := sha256.Sum256([]byte(expression))
+		for length, set := range t.prefixes {
+			if set[string(sum[:length])] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MatchLink reports whether any destination of u is on the list.
+func (t *threatList) MatchLink(u *URL) bool {
+	return t.ListedDestination(u) != ""
+}
+
+// ListedDestination returns the first destination of u that is on the
+// list, or "" if none is.
+func (t *threatList) ListedDestination(u *URL) string {
+	for _, destination := range linkDestinations(u) {
+		if t.Match(destination) {
+			return destination
+		}
+	}
+	return ""
+}
+
+// threatRefresher reloads the threat list every interval and rechecks the
+// stored links whenever it changed, starting with the list loaded at
+// startup.
+func (us *URLShortener) threatRefresher(interval time.Duration) {
+	defer us.wg.Done()
+
+	us.recheckLinks()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-us.quit:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			changed, err := us.threats.Refresh(ctx)
+			cancel()
+			if err != nil {
+				log.Printf("Error refreshing threat list: %v", err)
+				continue
+			}
+			if changed {
+				us.recheckLinks()
+			}
+		}
+	}
+}
+
+// recheckLinks flags the stored links whose destinations are on the threat
+// list and clears the flag of those that no longer are. Nothing is changed
+// while no list could be loaded.
+func (us *URLShortener) recheckLinks() {
+	if !us.threats.Loaded() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	flagged, cleared := 0, 0
+	for afterID := 0; ; {
+		select {
+		case <-us.quit:
+			return
+		default:
+		}
+
+		links, err := us.store.ScanURLs(ctx, afterID, recheckBatchSize)
+		if err != nil {
+			log.Printf("Error listing links to recheck: %v", err)
+			return
+		}
+		if len(links) == 0 {
+			break
+		}
+
+		for i := range links {
+			u := &links[i]
+			afterID = u.ID
+			listed := us.threats.MatchLink(u)
+			if listed == (u.FlaggedAt != nil) {
+				continue
+			}
+
+			var flaggedAt *time.Time
+			if listed {
+				now := time.Now().UTC()
+				flaggedAt = &now
+			}
+			if err := us.store.FlagURL(ctx, u.Domain, u.ShortCode, flaggedAt); err != nil {
+				log.Printf("Error flagging link %s: %v", u.ShortCode, err)
+				continue
+			}
+			us.invalidateURL(ctx, u.Domain, u.ShortCode)
+			if listed {
+				flagged++
+			} else {
+				cleared++
+			}
+		}
+	}
+
+	if flagged > 0 || cleared > 0 {
+		log.Printf("Threat list recheck flagged %d links and cleared %d", flagged, cleared)
+	}
+}
+
+// serveThreatWarning answers a request for a flagged link with a warning
+// page instead of a redirect. It runs after the password and schedule
+// checks; the page names the listed destination, except for single-use
+// links, whose destination is only revealed by the redirect.
+func (us *URLShortener) serveThreatWarning(w http.ResponseWriter, u *URL) {
+	var destination string
+	if !u.SingleUse {
+		destination = us.threats.ListedDestination(u)
+	}
+	renderPage(w, http.StatusForbidden, "warning.html", struct {
+		ShortURL    string
+		Destination string
+	}{us.shortURL(u), destination})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Analytics events are rolled up into hourly and daily buckets as they are
+// recorded, so traffic can be charted over periods far longer than the raw
+// rows returned by /api/stats. Buckets are aligned to UTC.
+
+const maxTimeseriesBuckets = 1000
+
+var timeseriesIntervals = []string{"hour", "day"}
+
+// bucketLength is exact because buckets are aligned to UTC.
+var bucketLength = map[string]time.Duration{
+	"hour": time.Hour,
+	"day":  24 * time.Hour,
+}
+
+var timeseriesDefaultRange = map[string]time.Duration{
+	"hour": 48 * time.Hour,
+	"day":  30 * 24 * time.Hour,
+}
+
+// TimeseriesBucket holds the clicks and unique visitors of one link in the
+// bucket starting at Start. Stores only keep clicks; the unique visitor
+// estimate comes from the sketches in uniques.go.
+type TimeseriesBucket struct {
+	Start                  time.Time `json:"start"`
+	Clicks                 int       `json:"clicks"`
+	UniqueVisitorsEstimate int       `json:"unique_visitors_estimate"`
+}
+
+// rollupKey identifies a bucket of a link's rollup at one interval.
+type rollupKey struct {
+	link     LinkKey
+	interval string
+	bucket   time.Time
+}
+
+func bucketStart(t time.Time, interval string) time.Time {
+	t = t.UTC()
+	if interval == "day" {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return t.Truncate(time.Hour)
+}
+
+func nextBucket(t time.Time, interval string) time.Time {
+	return t.Add(bucketLength[interval])
+}
+
+// fillTimeseries returns one bucket per interval in [from, to), taking
+// counts from stored and zero elsewhere.
+func fillTimeseries(stored []TimeseriesBucket, interval string, from, to time.Time) []TimeseriesBucket {
+	byStart := make(map[time.Time]TimeseriesBucket, len(stored))
+	for _, b := range stored {
+		byStart[b.Start.UTC()] = b
+	}
+
+	buckets := []TimeseriesBucket{}
+	for t := from; t.Before(to); t = nextBucket(t, interval) {
+		b, ok := byStart[t]
+		if !ok {
+			b = TimeseriesBucket{Start: t}
+		}
+		b.Start = t
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+func parseTimeParam(r *http.Request, name string, fallback time.Time) (time.Time, bool) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return fallback, true
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t.UTC(), true
+}
+
+func (us *URLShortener) timeseriesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	shortCode := mux.Vars(r)["shortCode"]
+
+	interval := r.URL.Query().Get("interval")
+	if interval == "" {
+		interval = "day"
+	}
+	defaultRange, ok := timeseriesDefaultRange[interval]
+	if !ok {
+		http.Error(w, "interval must be hour or day", http.StatusBadRequest)
+		return
+	}
+
+	to, ok := parseTimeParam(r, "to", time.Now().UTC())
+	if !ok {
+		http.Error(w, "to must be an RFC 3339 timestamp", http.StatusBadRequest)
+		return
+	}
+	from, ok := parseTimeParam(r, "from", to.Add(-defaultRange))
+	if !ok {
+		http.Error(w, "from must be an RFC 3339 timestamp", http.StatusBadRequest)
+		return
+	}
+
+	// Widen the range to whole buckets; to is exclusive.
+	from = bucketStart(from, interval)
+	if start := bucketStart(to, interval); !start.Equal(to) {
+		to = nextBucket(start, interval)
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+	if to.Sub(from)/bucketLength[interval] > maxTimeseriesBuckets {
+		http.Error(w, "Time range too large for this interval", http.StatusBadRequest)
+		return
+	}
+
+	domain, err := us.requestDomain(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	urlRecord, err := us.getOwnedURL(ctx, ownerFromContext(ctx), domain, shortCode)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			http.Error(w, "Request timeout", http.StatusRequestTimeout)
+			return
+		}
+		http.Error(w, "Short URL not found", http.StatusNotFound)
+		return
+	}
+
+	stored, err := us.store.GetTimeseries(ctx, domain, shortCode, interval, from, to)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			http.Error(w, "Request timeout", http.StatusRequestTimeout)
+			return
+		}
+		http.Error(w, "Error retrieving analytics", http.StatusInternalServerError)
+		return
+	}
+
+	buckets := fillTimeseries(stored, interval, from, to)
+	starts := make([]time.Time, len(buckets))
+	for i, b := range buckets {
+		starts[i] = b.Start
+	}
+	for i, n := range us.uniques.Buckets(ctx, LinkKey{domain, shortCode}, interval, starts) {
+		buckets[i].UniqueVisitorsEstimate = n
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"short_url":  us.shortURL(urlRecord),
+		"short_code": urlRecord.ShortCode,
+		"interval":   interval,
+		"from":       from,
+		"to":         to,
+		"buckets":    buckets,
+	})
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Unique visitors are estimated with HyperLogLog sketches of a visitor
+// fingerprint, a hash of the client IP and User-Agent. Each link has an
+// all-time sketch and one per UTC hour and day, kept in Redis with PFADD/PFCOUNT so
+// that all instances share them. Fingerprints that cannot be added to Redis
+// go into in-process sketches, which are counted alongside Redis (or alone,
+// while it is down) and re-added to Redis once it is reachable again.
+
+const (
+	uniquesKeyPrefix = "uv:"
+	// maxPendingFingerprints and maxLocalSketches bound the memory held
+	// while Redis is unreachable, at about 16KB per sketch. Fingerprints
+	// beyond either limit are dropped.
+	maxPendingFingerprints = 100000
+	maxLocalSketches       = 1000
+	uniquesRetryInterval   = 30 * time.Second
+)
+
+// visitorHashKey returns the key of visitor fingerprints: VISITOR_HASH_KEY,
+// or IP_HASH_KEY when only that is set. Without either a random key is used,
+// so instances do not share visitors and the count starts over on restart.
+func visitorHashKey(cfg *Config) ([]byte, error) {
+	if cfg.VisitorHashKey != "" {
+		return []byte(cfg.VisitorHashKey), nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generating visitor hash key: %w", err)
+	}
+	log.Printf("VISITOR_HASH_KEY is not set, unique visitors will not be merged across instances or restarts")
+	return key, nil
+}
+
+// visitorFingerprint hashes what identifies a visitor. It is computed from
+// the full IP before anonymization, so it is keyed with a secret: otherwise
+// trying every address of a truncated IP would recover the full one.
+func (us *URLShortener) visitorFingerprint(ipAddress, userAgent string) string {
+	ip := ipAddress
+	if parsed := parseClientIP(ipAddress); parsed != nil {
+		ip = parsed.String()
+	}
+	mac := hmac.New(sha256.New, us.visitorKey)
+	mac.Write([]byte(ip + "|" + userAgent))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func uniquesKey(link LinkKey) string {
+	return uniquesKeyPrefix + cacheKey(link.Domain, link.ShortCode)
+}
+
+// Hourly sketches are kept long enough to cover the longest hourly
+// timeseries, daily ones for over a year.
+var (
+	uniquesBucketFormat = map[string]string{"hour": "2006-01-02T15", "day": "2006-01-02"}
+	uniquesBucketTTL    = map[string]time.Duration{"hour": 45 * 24 * time.Hour, "day": 400 * 24 * time.Hour}
+)
+
+func uniquesBucketKey(link LinkKey, interval string, t time.Time) string {
+	return uniquesKey(link) + ":" + t.UTC().Format(uniquesBucketFormat[interval])
+}
+
+type pendingFingerprint struct {
+	link        LinkKey
+	at          time.Time
+	fingerprint string
+}
+
+type uniqueCounter struct {
+	rdb *redis.Client
+
+	mu       sync.Mutex
+	sketches map[string]*hyperLogLog
+	pending  []pendingFingerprint
+}
+
+func newUniqueCounter(rdb *redis.Client) *uniqueCounter {
+	return &uniqueCounter{rdb: rdb, sketches: make(map[string]*hyperLogLog)}
+}
+
+// Add records the visitor fingerprints of prepared events.
+func (c *uniqueCounter) Add(ctx context.Context, events []AnalyticsEvent) {
+	var fps []pendingFingerprint
+	for _, event := range events {
+		if event.VisitorHash != "" {
+			fps = append(fps, pendingFingerprint{LinkKey{event.Domain, event.ShortCode}, event.Timestamp, event.VisitorHash})
+		}
+	}
+	if len(fps) == 0 {
+		return
+	}
+
+	if err := c.pfadd(ctx, fps); err != nil {
+		log.Printf("Error adding %d visitor fingerprints to Redis, keeping them in process: %v", len(fps), err)
+		c.addLocal(fps)
+	}
+}
+
+func (c *uniqueCounter) pfadd(ctx context.Context, fps []pendingFingerprint) error {
+	_, err := c.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, fp := range fps {
+			pipe.PFAdd(ctx, uniquesKey(fp.link), fp.fingerprint)
+			for _, interval := range timeseriesIntervals {
+				key := uniquesBucketKey(fp.link, interval, fp.at)
+				pipe.PFAdd(ctx, key, fp.fingerprint)
+				pipe.Expire(ctx, key, uniquesBucketTTL[interval])
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// addLocal keeps fingerprints in process until Retry re-adds them to Redis.
+// The in-process sketches always hold exactly the pending fingerprints.
+func (c *uniqueCounter) addLocal(fps []pendingFingerprint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	dropped := 0
+	for _, fp := range fps {
+		if len(c.pending) >= maxPendingFingerprints || len(c.sketches)+c.missingSketches(fp) > maxLocalSketches {
+			dropped++
+			continue
+		}
+		c.addSketches(fp)
+		c.pending = append(c.pending, fp)
+	}
+	if dropped > 0 {
+		log.Printf("Dropped %d visitor fingerprints, too many are already held in process", dropped)
+	}
+}
+
+func sketchKeys(fp pendingFingerprint) []string {
+	keys := []string{uniquesKey(fp.link)}
+	for _, interval := range timeseriesIntervals {
+		keys = append(keys, uniquesBucketKey(fp.link, interval, fp.at))
+	}
+	return keys
+}
+
+// missingSketches counts the sketches adding fp would create.
+func (c *uniqueCounter) missingSketches(fp pendingFingerprint) int {
+	missing := 0
+	for _, key := range sketchKeys(fp) {
+		if c.sketches[key] == nil {
+			missing++
+		}
+	}
+	return missing
+}
+
+func (c *uniqueCounter) addSketches(fp pendingFingerprint) {
+	for _, key := range sketchKeys(fp) {
+		sketch := c.sketches[key]
+		if sketch == nil {
+			sketch = newHyperLogLog()
+			c.sketches[key] = sketch
+		}
+		sketch.Add(fp.fingerprint)
+	}
+}
+
+// Retry re-adds fingerprints kept in process to Redis, and rebuilds the
+// in-process sketches from those added since.
+func (c *uniqueCounter) Retry(ctx context.Context) {
+	c.mu.Lock()
+	pending := c.pending
+	c.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	if err := c.pfadd(ctx, pending); err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.pending = append([]pendingFingerprint(nil), c.pending[len(pending):]...)
+	c.sketches = make(map[string]*hyperLogLog)
+	for _, fp := range c.pending {
+		c.addSketches(fp)
+	}
+	c.mu.Unlock()
+	log.Printf("Re-added %d visitor fingerprints to Redis", len(pending))
+}
+
+func (c *uniqueCounter) localCount(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if sketch := c.sketches[key]; sketch != nil {
+		return sketch.Count()
+	}
+	return 0
+}
+
+// counts estimates several sketches in one round trip. While fingerprints
+// are held in process the Redis and in-process estimates are summed, which
+// can overcount visitors seen both before and during a Redis outage.
+func (c *uniqueCounter) counts(ctx context.Context, keys []string) []int {
+	result := make([]int, len(keys))
+	for i, key := range keys {
+		result[i] = c.localCount(key)
+	}
+
+	cmds := make([]*redis.IntCmd, len(keys))
+	_, err := c.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.PFCount(ctx, key)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error counting unique visitors in Redis: %v", err)
+		return result
+	}
+	for i, cmd := range cmds {
+		result[i] += int(cmd.Val())
+	}
+	return result
+}
+
+// Total estimates a link's unique visitors over its whole life.
+func (c *uniqueCounter) Total(ctx context.Context, link LinkKey) int {
+	return c.counts(ctx, []string{uniquesKey(link)})[0]
+}
+
+// Buckets estimates a link's unique visitors in the UTC hours or days
+// starting at starts.
+func (c *uniqueCounter) Buckets(ctx context.Context, link LinkKey, interval string, starts []time.Time) []int {
+	keys := make([]string, len(starts))
+	for i, start := range starts {
+		keys[i] = uniquesBucketKey(link, interval, start)
+	}
+	return c.counts(ctx, keys)
+}
+
+// uniquesRetrier periodically moves fingerprints kept in process to Redis.
+func (us *URLShortener) uniquesRetrier(interval time.Duration) {
+	defer us.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-us.quit:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(us.flushCtx, 10*time.Second)
+			us.uniques.Retry(ctx)
+			cancel()
+		}
+	}
+}
+
+// hllPrecision gives 2^14 registers and a standard error of about 0.8%,
+// the same as Redis.
+const hllPrecision = 14
+
+// hyperLogLog is a dense HyperLogLog sketch.
+type hyperLogLog struct {
+	registers [1 << hllPrecision]uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{}
+}
+
+func (h *hyperLogLog) Add(item string) {
+	hash := fnv.New64a()
+	hash.Write([]byte(item))
+	x := mix64(hash.Sum64())
+
+	idx := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+	}
+}
+
+// mix64 is the splitmix64 finalizer; it spreads FNV's output over the high
+// bits used to pick a register.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (h *hyperLogLog) Count() int {
+	const m = float64(len(h.registers))
+	alpha := 0.7213 / (1 + 1.079/m)
+
+	sum, zeros := 0.0, 0
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small cardinalities.
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int(estimate + 0.5)
+}
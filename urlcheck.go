@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Every destination of a link (long_url, fallback_url and the URLs of its
+// targeting rules and variants) passes these checks when it is created or
+// updated, in order:
+//
+//	scheme_not_allowed  scheme missing from ALLOWED_URL_SCHEMES
+//	invalid_url         not an absolute URL with a host
+//	self_referential    points at one of our own short domains
+//	chained_shortener   points at another URL shortener
+//	domain_denied       matches a deny rule of DOMAIN_RULES_FILE
+//	domain_not_allowed  matches no allow rule, when the file has any
+//	private_address     a loopback, private or link-local IP literal, when
+//	                    BLOCK_PRIVATE_DESTINATIONS is set
+//	threat_listed       on the threat list; see threats.go
+//
+// DOMAIN_RULES_FILE lists one rule per line:
+//
+//	# comments and blank lines are ignored
+//	allow  example.com
+//	deny   ads.example.com
+//
+// A rule covers the domain and all its subdomains. Deny rules win over allow
+// rules, and an allow rule also exempts a domain from the shortener check.
+
+// knownShorteners are public URL shorteners; links to them would hide the
+// real destination behind a second redirect.
+var knownShorteners = []string{
+	"bit.ly", "bitly.com", "tinyurl.com", "t.co", "goo.gl", "ow.ly",
+	"is.gd", "v.gd", "buff.ly", "rebrand.ly", "cutt.ly", "shorturl.at",
+	"tiny.cc", "rb.gy", "t.ly", "bl.ink", "s.id", "lnkd.in", "soo.gd",
+}
+
+// URLError is a destination rejected by one of the checks. Code identifies
+// the check; the error text starts with it.
+type URLError struct {
+	Code    string
+	Message string
+}
+
+func (e *URLError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+type urlValidator struct {
+	schemes      map[string]bool
+	selfHosts    map[string]bool
+	shorteners   []string
+	allow        []string
+	deny         []string
+	blockPrivate bool
+	threats      *threatList
+}
+
+// newURLValidator builds the checks from cfg, loading DOMAIN_RULES_FILE if
+// one is set.
+func newURLValidator(cfg *Config, threats *threatList) (*urlValidator, error) {
+	v := &urlValidator{
+		schemes:      make(map[string]bool),
+		selfHosts:    make(map[string]bool),
+		shorteners:   knownShorteners,
+		blockPrivate: cfg.BlockPrivateDestinations,
+		threats:      threats,
+	}
+	for _, scheme := range cfg.AllowedURLSchemes {
+		v.schemes[scheme] = true
+	}
+	for _, baseURL := range append([]string{cfg.BaseURL}, brandedBaseURLs(cfg)...) {
+		if u, err := url.Parse(baseURL); err == nil {
+			v.selfHosts[normalizeHost(u.Hostname())] = true
+		}
+	}
+
+	if cfg.DomainRulesFile == "" {
+		return v, nil
+	}
+	path := cfg.DomainRulesFile
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening domain rules: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: rule must be allow or deny followed by a domain", path, lineNo)
+		}
+		domain := normalizeHost(fields[1])
+		switch fields[0] {
+		case "allow":
+			v.allow = append(v.allow, domain)
+		case "deny":
+			v.deny = append(v.deny, domain)
+		default:
+			return nil, fmt.Errorf("%s:%d: rule must start with allow or deny", path, lineNo)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading domain rules: %w", err)
+	}
+
+	log.Printf("Loaded %d allow and %d deny domain rules from %s", len(v.allow), len(v.deny), path)
+	return v, nil
+}
+
+func brandedBaseURLs(cfg *Config) []string {
+	urls := make([]string, 0, len(cfg.BrandedDomains))
+	for _, baseURL := range cfg.BrandedDomains {
+		urls = append(urls, baseURL)
+	}
+	return urls
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// matchesDomain reports whether host is one of domains or a subdomain of one.
+func matchesDomain(host string, domains []string) bool {
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check validates a single destination URL.
+func (v *urlValidator) Check(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" {
+		return &URLError{"invalid_url", "invalid URL format"}
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if !v.schemes[scheme] {
+		return &URLError{"scheme_not_allowed", fmt.Sprintf("URL scheme %q is not allowed", scheme)}
+	}
+	if u.Host == "" {
+		return &URLError{"invalid_url", "invalid URL format"}
+	}
+
+	host := normalizeHost(u.Hostname())
+	if v.selfHosts[host] {
+		return &URLError{"self_referential", "URL points at this shortener"}
+	}
+	allowed := matchesDomain(host, v.allow)
+	if !allowed && matchesDomain(host, v.shorteners) {
+		return &URLError{"chained_shortener", fmt.Sprintf("%s is a URL shortener", host)}
+	}
+	if matchesDomain(host, v.deny) {
+		return &URLError{"domain_denied", fmt.Sprintf("links to %s are not allowed", host)}
+	}
+	if len(v.allow) > 0 && !allowed {
+		return &URLError{"domain_not_allowed", fmt.Sprintf("%s is not on the list of allowed domains", host)}
+	}
+
+	if v.blockPrivate && isPrivateHost(host) {
+		return &URLError{"private_address", "URL points at a private or loopback address"}
+	}
+
+	if v.threats.Match(raw) {
+		return &URLError{"threat_listed", fmt.Sprintf("%s is reported for phishing or malware", host)}
+	}
+	return nil
+}
+
+// linkDestinations lists every URL u may redirect to.
+func linkDestinations(u *URL) []string {
+	destinations := []string{u.LongURL}
+	if u.FallbackURL != "" {
+		destinations = append(destinations, u.FallbackURL)
+	}
+	for _, rule := range u.Targets {
+		destinations = append(destinations, rule.URL)
+	}
+	for _, variant := range u.Variants {
+		destinations = append(destinations, variant.URL)
+	}
+	return destinations
+}
+
+// CheckLink validates every destination of u.
+func (v *urlValidator) CheckLink(u *URL) error {
+	for _, destination := range linkDestinations(u) {
+		if err := v.Check(destination); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cgnatRange is the shared address space of carrier-grade NAT, which
+// net.IP.IsPrivate does not cover.
+var _, cgnatRange, _ = net.ParseCIDR("100.64.0.0/10")
+
+// isPrivateHost reports whether host is localhost or an IP literal that does
+// not reach the public internet. IPv4 literals are also recognized in the
+// shortened and numeric forms browsers accept, such as 127.1 or 2130706433.
+func isPrivateHost(host string) bool {
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ip = parseLooseIPv4(host)
+	}
+	if ip == nil {
+		return false
+	}
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		cgnatRange.Contains(ip)
+}
+
+// parseLooseIPv4 parses the inet_aton forms of an IPv4 address: one to four
+// parts in decimal, octal (leading 0) or hex (leading 0x), the last part
+// filling the remaining bytes.
+func parseLooseIPv4(host string) net.IP {
+	parts := strings.Split(host, ".")
+	if len(parts) > 4 {
+		return nil
+	}
+	values := make([]uint64, len(parts))
+	for i, part := range parts {
+		base := 10
+		switch {
+		case len(part) > 2 && (part[:2] == "0x" || part[:2] == "0X"):
+			part, base = part[2:], 16
+		case len(part) > 1 && part[0] == '0':
+			part, base = part[1:], 8
+		}
+		n, err := strconv.ParseUint(part, base, 32)
+		if err != nil {
+			return nil
+		}
+		values[i] = n
+	}
+
+	var addr uint64
+	for i, n := range values[:len(values)-1] {
+		if n > 0xff {
+			return nil
+		}
+		addr |= n << (24 - 8*uint(i))
+	}
+	last := values[len(values)-1]
+	if last >= 1<<(32-8*uint(len(values)-1)) {
+		return nil
+	}
+	addr |= last
+	return net.IPv4(byte(addr>>24), byte(addr>>16), byte(addr>>8), byte(addr))
+}
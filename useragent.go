@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// UserAgentInfo is what the analytics breakdowns need to know about a
+// User-Agent string. Empty fields mean the value was not recognised.
+// Whether the client is a bot is decided by the botClassifier.
+type UserAgentInfo struct {
+	Browser string
+	OS      string
+	Device  string
+}
+
+const (
+	deviceDesktop = "desktop"
+	deviceMobile  = "mobile"
+	deviceTablet  = "tablet"
+	deviceBot     = "bot"
+)
+
+// userAgentBrowsers is checked in order: most browsers also claim to be
+// the ones they are derived from (Edge and Opera include "Chrome/", Chrome
+// includes "Safari/"), so the more specific tokens come first.
+var userAgentBrowsers = []struct{ token, name string }{
+	{"edg/", "Edge"},
+	{"edge/", "Edge"},
+	{"opr/", "Opera"},
+	{"opera", "Opera"},
+	{"samsungbrowser/", "Samsung Internet"},
+	{"yabrowser/", "Yandex"},
+	{"vivaldi/", "Vivaldi"},
+	{"ucbrowser/", "UC Browser"},
+	{"firefox/", "Firefox"},
+	{"fxios/", "Firefox"},
+	{"crios/", "Chrome"},
+	{"chromium/", "Chromium"},
+	{"chrome/", "Chrome"},
+	{"safari/", "Safari"},
+	{"msie ", "Internet Explorer"},
+	{"trident/", "Internet Explorer"},
+}
+
+var userAgentOSes = []struct{ token, name string }{
+	{"windows phone", "Windows Phone"},
+	{"windows", "Windows"},
+	{"iphone", "iOS"},
+	{"ipad", "iOS"},
+	{"ipod", "iOS"},
+	{"android", "Android"},
+	{"; cros ", "ChromeOS"}, // not "cros", which matches "Microsoft"
+	{"mac os x", "macOS"},
+	{"macintosh", "macOS"},
+	{"linux", "Linux"},
+}
+
+func parseUserAgent(ua string) UserAgentInfo {
+	lower := strings.ToLower(ua)
+	var info UserAgentInfo
+
+	for _, b := range userAgentBrowsers {
+		if strings.Contains(lower, b.token) {
+			info.Browser = b.name
+			break
+		}
+	}
+
+	for _, o := range userAgentOSes {
+		if strings.Contains(lower, o.token) {
+			info.OS = o.name
+			break
+		}
+	}
+
+	switch {
+	case strings.Contains(lower, "ipad") || strings.Contains(lower, "tablet") ||
+		(strings.Contains(lower, "android") && !strings.Contains(lower, "mobile")):
+		info.Device = deviceTablet
+	case strings.Contains(lower, "mobi") || strings.Contains(lower, "iphone") || strings.Contains(lower, "ipod"):
+		info.Device = deviceMobile
+	case info.OS != "":
+		info.Device = deviceDesktop
+	}
+
+	return info
+}
+
+// referrerDomain returns the host of a Referer header without a leading
+// "www.", or "" for direct traffic and unparseable values.
+func referrerDomain(referrer string) string {
+	u, err := url.Parse(referrer)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
+
+// primaryLanguage returns the primary subtag of the first language in an
+// Accept-Language header, e.g. "en" for "en-US,en;q=0.9,de;q=0.8".
+func primaryLanguage(acceptLanguage string) string {
+	first, _, _ := strings.Cut(acceptLanguage, ",")
+	first, _, _ = strings.Cut(first, ";")
+	first, _, _ = strings.Cut(strings.TrimSpace(first), "-")
+	if first == "*" || len(first) > 8 {
+		return ""
+	}
+	return strings.ToLower(first)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// A link with variants splits its traffic between several destinations by
+// weight, e.g. 70/30. Each visitor keeps the variant they were first given:
+// it is remembered in a cookie, and visitors without the cookie are assigned
+// by a hash of the link and their visitor fingerprint, so they usually land
+// on the same variant even when cookies are blocked. Targeting rules are
+// checked first; only visitors they do not match are split. The variant of
+// each click is recorded in analytics.
+
+const (
+	maxVariants       = 10
+	maxVariantWeight  = 1000
+	variantCookie     = "link_variant"
+	variantCookieLife = 90 * 24 * time.Hour
+)
+
+// Variant is one weighted destination of a link. Variants created without
+// a name are named "A", "B", ... after their position.
+type Variant struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+// normalizeVariants validates variants and names them in place.
+func normalizeVariants(variants []Variant) error {
+	if len(variants) == 1 || len(variants) > maxVariants {
+		return fmt.Errorf("variants must list between 2 and %d destinations", maxVariants)
+	}
+
+	names := make(map[string]bool, len(variants))
+	for i := range variants {
+		v := &variants[i]
+		if v.Name == "" {
+			v.Name = string(rune('A' + i))
+		}
+		if names[v.Name] {
+			return fmt.Errorf("variant name %q is used twice", v.Name)
+		}
+		names[v.Name] = true
+
+		if !isValidURL(v.URL) {
+			return fmt.Errorf("variant %q: invalid URL format", v.Name)
+		}
+		if v.Weight < 1 || v.Weight > maxVariantWeight {
+			return fmt.Errorf("variant %q: weight must be between 1 and %d", v.Name, maxVariantWeight)
+		}
+	}
+	return nil
+}
+
+func findVariant(variants []Variant, name string) *Variant {
+	for i := range variants {
+		if variants[i].Name == name {
+			return &variants[i]
+		}
+	}
+	return nil
+}
+
+// assignVariant picks a variant by weight from a hash of the link and the
+// visitor.
+func (us *URLShortener) assignVariant(r *http.Request, u *URL) *Variant {
+	total := 0
+	for _, v := range u.Variants {
+		total += v.Weight
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(cacheKey(u.Domain, u.ShortCode)))
+	h.Write([]byte{0})
+	h.Write([]byte(us.visitorFingerprint(clientAddress(r), r.UserAgent())))
+	point := int(mix64(h.Sum64()) % uint64(total))
+
+	for i := range u.Variants {
+		if point < u.Variants[i].Weight {
+			return &u.Variants[i]
+		}
+		point -= u.Variants[i].Weight
+	}
+	return &u.Variants[len(u.Variants)-1]
+}
+
+// selectVariant returns the variant of u for the visitor making r, and
+// sets the cookie that keeps them on it.
+func (us *URLShortener) selectVariant(w http.ResponseWriter, r *http.Request, u *URL) *Variant {
+	if cookie, err := r.Cookie(variantCookie); err == nil {
+		if name, err := url.QueryUnescape(cookie.Value); err == nil {
+			if v := findVariant(u.Variants, name); v != nil {
+				return v
+			}
+		}
+	}
+
+	v := us.assignVariant(r, u)
+	http.SetCookie(w, &http.Cookie{
+		Name:     variantCookie,
+		Value:    url.QueryEscape(v.Name),
+		Path:     "/" + u.ShortCode,
+		MaxAge:   int(variantCookieLife / time.Second),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(us.shortURL(u), "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return v
+}
+
+// VariantStats is the traffic of one variant in the stats response.
+type VariantStats struct {
+	Variant
+	Clicks int `json:"clicks"`
+}
+
+// variantStats lists every variant of u with its clicks from the variants
+// breakdown, including variants nobody was sent to yet.
+func variantStats(u *URL, breakdown []BreakdownEntry) []VariantStats {
+	clicks := make(map[string]int, len(breakdown))
+	for _, entry := range breakdown {
+		clicks[entry.Value] = entry.Clicks
+	}
+
+	stats := make([]VariantStats, len(u.Variants))
+	for i, v := range u.Variants {
+		stats[i] = VariantStats{Variant: v, Clicks: clicks[v.Name]}
+	}
+	return stats
+}